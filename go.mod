@@ -2,13 +2,23 @@ module github.com/LeeMartin77/SimpleMediaGallery
 
 go 1.21
 
+require (
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/gabriel-vasile/mimetype v1.4.3
+	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
+	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd
+	github.com/srwiley/oksvg v0.0.0-20221011165216-be6e8873101c
+	github.com/srwiley/rasterx v0.0.0-20220730225603-2ab79fcdd4ef
+	github.com/u2takey/ffmpeg-go v0.5.0
+	go.etcd.io/bbolt v1.3.8
+	golang.org/x/image v0.14.0
+	golang.org/x/text v0.14.0
+)
+
 require (
 	github.com/aws/aws-sdk-go v1.38.20 // indirect
-	github.com/gabriel-vasile/mimetype v1.4.3 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
-	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646 // indirect
-	github.com/u2takey/ffmpeg-go v0.5.0 // indirect
 	github.com/u2takey/go-utils v0.3.1 // indirect
-	golang.org/x/image v0.14.0 // indirect
 	golang.org/x/net v0.17.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
 )
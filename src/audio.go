@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/language/display"
+)
+
+// AudioTrack is one of a video's audio streams, and where the player can
+// get the video with that audio
+type AudioTrack struct {
+	Label  string
+	Source string
+	Type   string
+	// Remux streams can't be seeked into, the player asks for a new one
+	Remux bool
+}
+
+// audioMap is the ffmpeg map for an audio stream, -1 meaning the first one
+// if there is one
+func audioMap(audio int) string {
+	if audio < 0 {
+		return "0:a:0?"
+	}
+	return fmt.Sprintf("0:%d", audio)
+}
+
+// audioStream reads the audio query parameter, the index of one of the
+// video's audio streams. It's -1 when there isn't one.
+func audioStream(probe FFMpegProbe, query url.Values) (int, bool) {
+	if !query.Has("audio") {
+		return -1, true
+	}
+	index, err := strconv.Atoi(query.Get("audio"))
+	if err != nil {
+		return -1, false
+	}
+	for _, stream := range probe.Streams {
+		if stream.CodecType == "audio" && stream.Index == index {
+			return index, true
+		}
+	}
+	return -1, false
+}
+
+// label names a stream for people picking between them
+func (stream FFMPegStreamFormat) label(number int) string {
+	labels := []string{}
+	if tag, ok := languageTag(stream.Tags.Language); ok {
+		labels = append(labels, display.English.Tags().Name(tag))
+	}
+	if stream.Tags.Title != "" {
+		labels = append(labels, stream.Tags.Title)
+	}
+	if len(labels) == 0 {
+		labels = append(labels, fmt.Sprintf("Track %d", number))
+	}
+	return strings.Join(labels, " - ")
+}
+
+// audioTracks lists a video's audio streams for the content viewer. The
+// first plays from the usual stream source, the others have to be remuxed
+// or transcoded with that audio in place of the first.
+func audioTracks(path string, probe FFMpegProbe, source string, sourceType string, mode string) []AudioTrack {
+	tracks := []AudioTrack{}
+	for _, stream := range probe.Streams {
+		if stream.CodecType != "audio" {
+			continue
+		}
+		track := AudioTrack{Label: stream.label(len(tracks) + 1)}
+		if len(tracks) == 0 {
+			track.Source = (&url.URL{Path: source}).EscapedPath()
+			track.Type = sourceType
+			track.Remux = mode == playbackRemux
+		} else if canRemux(probe) {
+			track.Source = (&url.URL{Path: "/_stream" + path, RawQuery: fmt.Sprintf("audio=%d", stream.Index)}).String()
+			track.Type = "video/mp4"
+			track.Remux = true
+		} else {
+			track.Source = (&url.URL{Path: "/_hls" + path, RawQuery: fmt.Sprintf("audio=%d", stream.Index)}).String()
+			track.Type = "application/x-mpegURL"
+		}
+		tracks = append(tracks, track)
+	}
+	return tracks
+}
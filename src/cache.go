@@ -0,0 +1,349 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiskCache is a size bounded store of blobs on disk, evicting the least
+// recently used entries once MaxBytes is exceeded. Recency is kept in the
+// file modification times so it survives a restart.
+type DiskCache struct {
+	Directory string
+	MaxBytes  int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	recency *list.List // front is most recently used
+	size    int64
+	// sources has the keys cached for each source, so pruning one source
+	// doesn't look through everything
+	sources map[string]map[string]bool
+}
+
+type diskCacheEntry struct {
+	key  string
+	size int64
+}
+
+func NewDiskCache(directory string, maxBytes int64) (*DiskCache, error) {
+	err := os.MkdirAll(directory, 0755)
+	if err != nil {
+		return nil, err
+	}
+	cache := &DiskCache{
+		Directory: directory,
+		MaxBytes:  maxBytes,
+		entries:   map[string]*list.Element{},
+		recency:   list.New(),
+		sources:   map[string]map[string]bool{},
+	}
+
+	type found struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	existing := []found{}
+	err = filepath.WalkDir(directory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			// half written entry from a previous run
+			os.Remove(path)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		existing = append(existing, found{d.Name(), info.Size(), info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(existing, func(i, j int) bool {
+		return existing[i].modTime.After(existing[j].modTime)
+	})
+	for _, f := range existing {
+		cache.entries[f.key] = cache.recency.PushBack(&diskCacheEntry{key: f.key, size: f.size})
+		cache.size += f.size
+		cache.track(f.key)
+	}
+	cache.mu.Lock()
+	cache.evict()
+	cache.mu.Unlock()
+	return cache, nil
+}
+
+func (c *DiskCache) pathFor(key string) string {
+	shard := key
+	if len(shard) > 2 {
+		shard = shard[:2]
+	}
+	return filepath.Join(c.Directory, shard, key)
+}
+
+// Get returns the cached blob for key. A nil cache never has anything.
+func (c *DiskCache) Get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	elem, ok := c.entries[key]
+	if ok {
+		c.recency.MoveToFront(elem)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	path := c.pathFor(key)
+	byts, err := os.ReadFile(path)
+	if err != nil {
+		c.remove(key)
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return byts, true
+}
+
+// Has reports whether key is cached without touching its recency.
+func (c *DiskCache) Has(key string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[key]
+	return ok
+}
+
+// Put stores data under key, evicting older entries if the cache is full.
+func (c *DiskCache) Put(key string, data []byte) error {
+	if c == nil {
+		return nil
+	}
+	path := c.pathFor(key)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+key)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.size -= elem.Value.(*diskCacheEntry).size
+		c.recency.Remove(elem)
+	}
+	c.entries[key] = c.recency.PushFront(&diskCacheEntry{key: key, size: int64(len(data))})
+	c.size += int64(len(data))
+	c.track(key)
+	c.evict()
+	return nil
+}
+
+// Prune removes every entry starting with prefix, apart from those that
+// also start with keep. Pass an empty keep to drop them all.
+func (c *DiskCache) Prune(prefix string, keep string) {
+	if c == nil {
+		return
+	}
+	stale := []string{}
+	c.mu.Lock()
+	matches := func(key string) {
+		if strings.HasPrefix(key, prefix) && (keep == "" || !strings.HasPrefix(key, keep)) {
+			stale = append(stale, key)
+		}
+	}
+	if source, _, found := strings.Cut(prefix, "-"); found {
+		// everything matching is from the one source
+		for key := range c.sources[source] {
+			matches(key)
+		}
+	} else {
+		for key := range c.entries {
+			matches(key)
+		}
+	}
+	c.mu.Unlock()
+	for _, key := range stale {
+		c.remove(key)
+	}
+}
+
+func (c *DiskCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.size -= elem.Value.(*diskCacheEntry).size
+	c.recency.Remove(elem)
+	delete(c.entries, key)
+	c.untrack(key)
+	os.Remove(c.pathFor(key))
+}
+
+// cacheSource is the part of a key naming the source it was made from
+func cacheSource(key string) string {
+	source, _, _ := strings.Cut(key, "-")
+	return source
+}
+
+// track and untrack must be called with the lock held
+func (c *DiskCache) track(key string) {
+	source := cacheSource(key)
+	if c.sources[source] == nil {
+		c.sources[source] = map[string]bool{}
+	}
+	c.sources[source][key] = true
+}
+
+func (c *DiskCache) untrack(key string) {
+	source := cacheSource(key)
+	delete(c.sources[source], key)
+	if len(c.sources[source]) == 0 {
+		delete(c.sources, source)
+	}
+}
+
+// evict must be called with the lock held
+func (c *DiskCache) evict() {
+	for c.MaxBytes > 0 && c.size > c.MaxBytes {
+		elem := c.recency.Back()
+		if elem == nil {
+			return
+		}
+		entry := elem.Value.(*diskCacheEntry)
+		c.size -= entry.size
+		c.recency.Remove(elem)
+		delete(c.entries, entry.key)
+		c.untrack(entry.key)
+		os.Remove(c.pathFor(entry.key))
+	}
+}
+
+func hashKey(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:24]
+}
+
+// sourceCacheKey is the prefix shared by everything cached for a source
+// file, regardless of which version of the file it was generated from
+func sourceCacheKey(path string) string {
+	return hashKey(path)
+}
+
+// sourceVersionKey identifies a particular version of the source file
+func sourceVersionKey(path string, info fs.FileInfo) string {
+	return sourceCacheKey(path) + "-" + hashKey(path, fmt.Sprint(info.ModTime().UnixNano()), fmt.Sprint(info.Size()))
+}
+
+// derivedCacheKey names a variant (size, format, ...) generated from a
+// particular version of a source file
+func derivedCacheKey(path string, info fs.FileInfo, variant string) string {
+	return sourceVersionKey(path, info) + "-" + hashKey(variant)
+}
+
+// putDerived stores a derived variant and drops anything cached from
+// older versions of the same source
+func (c *DiskCache) putDerived(path string, info fs.FileInfo, variant string, data []byte) error {
+	if c == nil {
+		return nil
+	}
+	c.Prune(sourceCacheKey(path)+"-", sourceVersionKey(path, info)+"-")
+	return c.Put(derivedCacheKey(path, info, variant), data)
+}
+
+// memoryCache is a small least recently used cache of values kept in
+// memory, bounded by how many it holds
+type memoryCache[V any] struct {
+	MaxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	recency *list.List // front is most recently used
+}
+
+type memoryCacheEntry[V any] struct {
+	key   string
+	value V
+}
+
+func newMemoryCache[V any](maxEntries int) *memoryCache[V] {
+	return &memoryCache[V]{MaxEntries: maxEntries, entries: map[string]*list.Element{}, recency: list.New()}
+}
+
+func (c *memoryCache[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		var none V
+		return none, false
+	}
+	c.recency.MoveToFront(elem)
+	return elem.Value.(*memoryCacheEntry[V]).value, true
+}
+
+func (c *memoryCache[V]) Put(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*memoryCacheEntry[V]).value = value
+		c.recency.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.recency.PushFront(&memoryCacheEntry[V]{key: key, value: value})
+	for c.recency.Len() > c.MaxEntries {
+		oldest := c.recency.Back()
+		c.recency.Remove(oldest)
+		delete(c.entries, oldest.Value.(*memoryCacheEntry[V]).key)
+	}
+}
+
+// Prune forgets every key starting with prefix
+func (c *memoryCache[V]) Prune(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, elem := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.recency.Remove(elem)
+			delete(c.entries, key)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDiskCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache, err := NewDiskCache(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Put("aaaa", []byte("12345"))
+	cache.Put("bbbb", []byte("12345"))
+	if _, ok := cache.Get("aaaa"); !ok {
+		t.Fatal("Expected aaaa to be cached")
+	}
+	cache.Put("cccc", []byte("12345"))
+
+	if !cache.Has("aaaa") || !cache.Has("cccc") {
+		t.Errorf("Expected recently used entries to survive")
+	}
+	if cache.Has("bbbb") {
+		t.Errorf("Expected bbbb to be evicted")
+	}
+}
+
+func TestDiskCacheSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewDiskCache(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Put("aaaa", []byte("thumbnail"))
+
+	reopened, err := NewDiskCache(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byts, ok := reopened.Get("aaaa")
+	if !ok || !bytes.Equal(byts, []byte("thumbnail")) {
+		t.Errorf("Expected thumbnail, got %v", byts)
+	}
+}
+
+func TestDiskCachePruneKeepsCurrentVersion(t *testing.T) {
+	cache, err := NewDiskCache(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Put("src-old-w300", []byte("old"))
+	cache.Put("src-new-w300", []byte("new"))
+	cache.Put("other-old-w300", []byte("other"))
+
+	cache.Prune("src-", "src-new-")
+
+	if cache.Has("src-old-w300") {
+		t.Errorf("Expected stale version to be pruned")
+	}
+	if !cache.Has("src-new-w300") || !cache.Has("other-old-w300") {
+		t.Errorf("Expected current and unrelated entries to survive")
+	}
+
+	// what's found on disk can be pruned by source too
+	reopened, err := NewDiskCache(cache.Directory, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.Prune("other-", "")
+	if reopened.Has("other-old-w300") || len(reopened.sources) != 1 {
+		t.Errorf("Expected other's entries to be pruned, but got %v", reopened.sources)
+	}
+}
+
+func TestNilDiskCacheIsAlwaysEmpty(t *testing.T) {
+	var cache *DiskCache
+	if err := cache.Put("aaaa", []byte("12345")); err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+	if _, ok := cache.Get("aaaa"); ok {
+		t.Errorf("Expected nil cache to miss")
+	}
+}
+
+func TestMemoryCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newMemoryCache[int](2)
+	cache.Put("a", 1)
+	cache.Put("b", 2)
+	cache.Get("a")
+	cache.Put("c", 3)
+	if _, ok := cache.Get("b"); ok {
+		t.Errorf("Expected b to be evicted")
+	}
+	if value, ok := cache.Get("a"); !ok || value != 1 {
+		t.Errorf("Expected 1, but got %v", value)
+	}
+	cache.Prune("c")
+	if _, ok := cache.Get("c"); ok {
+		t.Errorf("Expected c to be pruned")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sync"
+)
+
+// GALLERY_PROBE_CONCURRENCY is how many videos on a gallery page are probed
+// for their duration and resolution at once
+var GALLERY_PROBE_CONCURRENCY = 4
+
+// formatDuration shows seconds the way players do, 1:05 or 2:00:00
+func formatDuration(seconds float64) string {
+	if seconds < 0 || math.IsNaN(seconds) {
+		seconds = 0
+	}
+	total := int(seconds)
+	hours, minutes, remainder := total/3600, total/60%60, total%60
+	if hours > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", hours, minutes, remainder)
+	}
+	return fmt.Sprintf("%d:%02d", minutes, remainder)
+}
+
+// resolutionLabel names a video's resolution by its shorter side, so
+// portrait phone videos get the same labels as landscape ones
+func resolutionLabel(width int, height int) string {
+	side := int(math.Min(float64(width), float64(height)))
+	switch {
+	case side <= 0:
+		return ""
+	case side >= 2160:
+		return "4K"
+	case side >= 1440:
+		return "1440p"
+	case side >= 1080:
+		return "1080p"
+	case side >= 720:
+		return "720p"
+	}
+	return "SD"
+}
+
+// addVideoDetails fills in the duration and resolution of the videos on a
+// gallery page that the library index didn't already know about. Videos
+// that can't be probed just go without.
+func (hdlr RequestHandlers) addVideoDetails(files []GalleryFileData) {
+	limiter := make(chan struct{}, GALLERY_PROBE_CONCURRENCY)
+	var wg sync.WaitGroup
+	for i := range files {
+		if !files[i].IsVideo || files[i].Duration != "" {
+			// already known from the library index
+			continue
+		}
+		wg.Add(1)
+		go func(file *GalleryFileData) {
+			defer wg.Done()
+			limiter <- struct{}{}
+			defer func() { <-limiter }()
+			path := hdlr.MediaDirectory + file.Link
+			info, err := os.Stat(path)
+			if err != nil {
+				return
+			}
+			probe, err := readCachedProbe(path, info)
+			if err != nil {
+				return
+			}
+			if duration, err := probe.DurationSeconds(); err == nil {
+				file.Duration = formatDuration(duration)
+			}
+			for _, stream := range probe.Streams {
+				if stream.CodecType == "video" {
+					file.Resolution = resolutionLabel(stream.Width, stream.Height)
+					break
+				}
+			}
+		}(&files[i])
+	}
+	wg.Wait()
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestFormatDuration(t *testing.T) {
+	cases := map[float64]string{
+		0:       "0:00",
+		5.9:     "0:05",
+		65:      "1:05",
+		600:     "10:00",
+		3600:    "1:00:00",
+		7265.4:  "2:01:05",
+		-3:      "0:00",
+		36000.5: "10:00:00",
+	}
+	for seconds, expected := range cases {
+		if got := formatDuration(seconds); got != expected {
+			t.Errorf("Expected %s for %f, but got %s", expected, seconds, got)
+		}
+	}
+}
+
+func TestResolutionLabel(t *testing.T) {
+	cases := []struct {
+		width, height int
+		expected      string
+	}{
+		{3840, 2160, "4K"},
+		{1920, 1080, "1080p"},
+		{1080, 1920, "1080p"},
+		{1280, 720, "720p"},
+		{640, 480, "SD"},
+		{0, 0, ""},
+	}
+	for _, c := range cases {
+		if got := resolutionLabel(c.width, c.height); got != c.expected {
+			t.Errorf("Expected %s for %dx%d, but got %s", c.expected, c.width, c.height, got)
+		}
+	}
+}
+
+func TestGalleryFileDataMarksVideos(t *testing.T) {
+	if !newGalleryFileData("a.MKV", "/a.MKV", "/_thumbnail/a.MKV").IsVideo {
+		t.Errorf("Expected a.MKV to be a video")
+	}
+	if newGalleryFileData("a.gif", "/a.gif", "/_thumbnail/a.gif").IsVideo {
+		t.Errorf("Expected a.gif not to be a video")
+	}
+}
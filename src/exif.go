@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"image"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// readExif finds the exif block in jpeg and tiff files, falling back to
+// looking for it anywhere in the file for containers like heif, webp and
+// png that tuck it away in their own boxes and chunks
+func readExif(fileContents []byte) (*exif.Exif, error) {
+	x, err := exif.Decode(bytes.NewReader(fileContents))
+	if err == nil || !exif.IsCriticalError(err) {
+		return x, nil
+	}
+	for _, marker := range [][]byte{[]byte("Exif\x00\x00"), []byte("II*\x00"), []byte("MM\x00*")} {
+		offset := bytes.Index(fileContents, marker)
+		if offset < 0 {
+			continue
+		}
+		found, foundErr := exif.Decode(bytes.NewReader(fileContents[offset:]))
+		if foundErr == nil || !exif.IsCriticalError(foundErr) {
+			return found, nil
+		}
+	}
+	return nil, err
+}
+
+// exifOrientation is the orientation tag, from 1 (as stored) to 8, or 1
+// when there isn't one
+func exifOrientation(fileContents []byte) int {
+	x, err := readExif(fileContents)
+	if err != nil {
+		return 1
+	}
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+	orientation, err := tag.Int(0)
+	if err != nil || orientation < 1 || orientation > 8 {
+		return 1
+	}
+	return orientation
+}
+
+// applyOrientation rotates and flips img so that it's the way up the
+// camera intended, given its exif orientation
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	// 5 to 8 swap width and height
+	transposed := orientation >= 5
+	dstW, dstH := w, h
+	if transposed {
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // flip horizontally
+				dx, dy = w-1-x, y
+			case 3: // rotate 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // flip vertically
+				dx, dy = x, h-1-y
+			case 5: // transpose
+				dx, dy = y, x
+			case 6: // rotate 90 clockwise
+				dx, dy = h-1-y, x
+			case 7: // transverse
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotate 90 anticlockwise
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// galleryTypes are the kinds of file the gallery can be filtered to, in
+// the order the filters are shown
+var galleryTypes = []string{"image", "video", "audio", "other"}
+
+// TypeFilter is which files a gallery shows, from the visible and ext
+// parameters. A file is shown if its type or its extension is picked, and
+// everything is shown if nothing is.
+type TypeFilter struct {
+	Types      []string
+	Extensions []string
+}
+
+func readTypeFilter(query url.Values) TypeFilter {
+	filter := TypeFilter{Types: []string{}, Extensions: []string{}}
+	for _, typ := range query["visible"] {
+		if slices.Contains(galleryTypes, typ) && !slices.Contains(filter.Types, typ) {
+			filter.Types = append(filter.Types, typ)
+		}
+	}
+	for _, ext := range query["ext"] {
+		ext = strings.ToLower(strings.TrimPrefix(ext, "."))
+		if ext != "" && !slices.Contains(filter.Extensions, ext) {
+			filter.Extensions = append(filter.Extensions, ext)
+		}
+	}
+	return filter
+}
+
+func (filter TypeFilter) active() bool {
+	return len(filter.Types) > 0 || len(filter.Extensions) > 0
+}
+
+func (filter TypeFilter) allows(entry IndexEntry) bool {
+	if entry.IsDir || !filter.active() {
+		return true
+	}
+	return slices.Contains(filter.Types, entry.Type) || slices.Contains(filter.Extensions, entryExtension(entry))
+}
+
+func entryExtension(entry IndexEntry) string {
+	return strings.ToLower(strings.TrimPrefix(pathExt(entry.Name), "."))
+}
+
+// Values are the parameters that ask for this filter again
+func (filter TypeFilter) Values() url.Values {
+	values := url.Values{}
+	for _, typ := range filter.Types {
+		values.Add("visible", typ)
+	}
+	for _, ext := range filter.Extensions {
+		values.Add("ext", ext)
+	}
+	return values
+}
+
+// toggle picks or unpicks one of a filter's values
+func toggle(values []string, value string) []string {
+	if slices.Contains(values, value) {
+		return slices.DeleteFunc(slices.Clone(values), func(v string) bool { return v == value })
+	}
+	return append(slices.Clone(values), value)
+}
+
+// FilterLink is a filter that can be switched on or off
+type FilterLink struct {
+	Label  string
+	Active bool
+	URL    string
+}
+
+// filterFiles applies a filter to what's in a directory or found by a
+// search, and works out the filters worth offering for them
+func filterFiles(entries []IndexEntry, filter TypeFilter) (shown []IndexEntry, types []string, extensions []string) {
+	shown = []IndexEntry{}
+	found := map[string]bool{}
+	extensions = []string{}
+	for _, entry := range entries {
+		if !entry.IsDir {
+			found[entry.Type] = true
+			if ext := entryExtension(entry); ext != "" && !slices.Contains(extensions, ext) {
+				extensions = append(extensions, ext)
+			}
+		}
+		if filter.allows(entry) {
+			shown = append(shown, entry)
+		}
+	}
+	types = []string{}
+	for _, typ := range galleryTypes {
+		if found[typ] {
+			types = append(types, typ)
+		}
+	}
+	slices.Sort(extensions)
+	return shown, types, extensions
+}
+
+// pageValues are the parameters that get back to this gallery, its search,
+// sort and filters
+func (gallery GalleryData) pageValues() url.Values {
+	values := gallery.Sorting.Values()
+	if gallery.Query != "" {
+		values.Set("query", gallery.Query)
+	}
+	for key, value := range gallery.filter().Values() {
+		values[key] = value
+	}
+	return values
+}
+
+func (gallery GalleryData) filter() TypeFilter {
+	return TypeFilter{Types: gallery.VisibleTypes, Extensions: gallery.VisibleExtensions}
+}
+
+func (gallery GalleryData) filterLink(filter TypeFilter) string {
+	values := gallery.pageValues()
+	values.Del("visible")
+	values.Del("ext")
+	for key, value := range filter.Values() {
+		values[key] = value
+	}
+	return gallery.URL + "?" + values.Encode()
+}
+
+// TypeFilters switch each of the types on the page on or off, keeping the
+// others as they are
+func (gallery GalleryData) TypeFilters() []FilterLink {
+	links := []FilterLink{}
+	for _, typ := range gallery.AvailableTypes {
+		filter := gallery.filter()
+		filter.Types = toggle(filter.Types, typ)
+		links = append(links, FilterLink{Label: typ, Active: slices.Contains(gallery.VisibleTypes, typ), URL: gallery.filterLink(filter)})
+	}
+	return links
+}
+
+// ExtensionFilters are the same for each extension on the page
+func (gallery GalleryData) ExtensionFilters() []FilterLink {
+	links := []FilterLink{}
+	for _, ext := range gallery.AvailableExtensions {
+		filter := gallery.filter()
+		filter.Extensions = toggle(filter.Extensions, ext)
+		links = append(links, FilterLink{Label: "." + ext, Active: slices.Contains(gallery.VisibleExtensions, ext), URL: gallery.filterLink(filter)})
+	}
+	return links
+}
+
+// ClearFiltersURL shows everything again
+func (gallery GalleryData) ClearFiltersURL() string {
+	return gallery.filterLink(TypeFilter{})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"html/template"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadTypeFilter(t *testing.T) {
+	query, _ := url.ParseQuery("visible=video&visible=nonsense&visible=video&ext=.PNG&ext=")
+	filter := readTypeFilter(query)
+	if strings.Join(filter.Types, ",") != "video" || strings.Join(filter.Extensions, ",") != "png" {
+		t.Errorf("Expected video and png, but got %+v", filter)
+	}
+}
+
+func TestFilterFiles(t *testing.T) {
+	entries := []IndexEntry{
+		{Name: "holidays", IsDir: true, Type: "directory"},
+		{Name: "a.png", Type: "image"},
+		{Name: "b.jpg", Type: "image"},
+		{Name: "c.mp4", Type: "video"},
+		{Name: "d.mp3", Type: "audio"},
+		{Name: "notes", Type: "other"},
+	}
+	names := func(entries []IndexEntry) string {
+		parts := []string{}
+		for _, entry := range entries {
+			parts = append(parts, entry.Name)
+		}
+		return strings.Join(parts, ",")
+	}
+	shown, types, extensions := filterFiles(entries, TypeFilter{})
+	if len(shown) != len(entries) || strings.Join(types, ",") != "image,video,audio,other" || strings.Join(extensions, ",") != "jpg,mp3,mp4,png" {
+		t.Errorf("Expected everything, but got %s %v %v", names(shown), types, extensions)
+	}
+	shown, _, _ = filterFiles(entries, TypeFilter{Types: []string{"video", "audio"}, Extensions: []string{"png"}})
+	if names(shown) != "holidays,a.png,c.mp4,d.mp3" {
+		t.Errorf("Expected folders, pngs, videos and audio, but got %s", names(shown))
+	}
+}
+
+func TestGalleryFilters(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.png", "b.jpg", "c.mp4", "d.mp3"} {
+		os.WriteFile(filepath.Join(dir, name), []byte{}, 0644)
+	}
+	hdlr := RequestHandlers{MediaDirectory: dir, Stat: os.Stat, ReadDir: os.ReadDir}
+	query, _ := url.ParseQuery("visible=image&ext=mp3&sort=name&order=desc")
+	gallery := hdlr.getPageData("/", query, 1, 2).GalleryData
+	links := []string{}
+	for _, file := range gallery.Files {
+		links = append(links, file.Link)
+	}
+	if strings.Join(links, ",") != "/d.mp3,/b.jpg" || !gallery.HasMore {
+		t.Errorf("Expected the first page of images and mp3s, but got %v", links)
+	}
+	if strings.Join(gallery.VisibleTypes, ",") != "image" || strings.Join(gallery.AvailableTypes, ",") != "image,video,audio" {
+		t.Errorf("Expected image to be picked out of image, video and audio, but got %v of %v", gallery.VisibleTypes, gallery.AvailableTypes)
+	}
+	expected := "/?ext=mp3&order=desc&pageNum=2&sort=name&visible=image"
+	if gallery.NextPageURL() != expected {
+		t.Errorf("Expected the next page to be %s, but got %s", expected, gallery.NextPageURL())
+	}
+	filters := gallery.TypeFilters()
+	if !filters[0].Active || filters[0].URL != "/?ext=mp3&order=desc&sort=name" {
+		t.Errorf("Expected turning image off to leave the rest, but got %+v", filters[0])
+	}
+}
+
+func TestSearchFilters(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"beach.png", "beach.mp4"} {
+		os.WriteFile(filepath.Join(dir, name), []byte{}, 0644)
+	}
+	templates := template.Must(template.New("").Parse(`{{ define "baseHTML" }}{{ range .GalleryData.Files }}{{ .Link }} {{ end }}{{ .GalleryData.VisibleTypes }}{{ end }}`))
+	hdlr := RequestHandlers{MediaDirectory: dir, ReadDir: os.ReadDir, Templates: templates}
+	rec := httptest.NewRecorder()
+	hdlr.performSearch(rec, httptest.NewRequest("GET", "/_search/?query=beach&visible=video", nil))
+	if rec.Body.String() != "/beach.mp4 [video]" {
+		t.Errorf("Expected only the video, but got %s", rec.Body.String())
+	}
+}
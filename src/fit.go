@@ -0,0 +1,167 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"math"
+
+	"github.com/nfnt/resize"
+)
+
+// How a thumbnail is fitted when both a width and height are asked for
+var thumbnailFits = []string{"contain", "cover", "fill"}
+
+// Where a cover crop is taken from, entropy and attention look for the
+// busiest or most eye catching part of the image
+var thumbnailGravities = []string{"center", "top", "bottom", "left", "right", "entropy", "attention"}
+
+// fitImage scales img to the requested box. A zero width or height keeps
+// the aspect ratio from the other.
+func fitImage(img image.Image, width uint, height uint, fit string, gravity string) image.Image {
+	bounds := img.Bounds()
+	srcW, srcH := float64(bounds.Dx()), float64(bounds.Dy())
+	if width == 0 && height == 0 {
+		return img
+	}
+	if width == 0 || height == 0 || fit == "fill" {
+		if uint(bounds.Dx()) == width && (height == 0 || uint(bounds.Dy()) == height) {
+			return img
+		}
+		return resize.Resize(width, height, img, resize.Bilinear)
+	}
+
+	if fit != "cover" {
+		scale := math.Min(float64(width)/srcW, float64(height)/srcH)
+		return resize.Resize(uint(math.Round(srcW*scale)), uint(math.Round(srcH*scale)), img, resize.Bilinear)
+	}
+
+	// crop the source to the box's shape first, scaling it up to cover the
+	// box could need a huge image for a long thin one
+	aspect := float64(width) / float64(height)
+	cropW, cropH := srcW, srcH
+	if srcW/srcH > aspect {
+		cropW = math.Max(1, math.Round(srcH*aspect))
+	} else {
+		cropH = math.Max(1, math.Round(srcW/aspect))
+	}
+	cropped := cropImage(img, cropWindow(img, int(cropW), int(cropH), gravity))
+	return resize.Resize(width, height, cropped, resize.Bilinear)
+}
+
+func cropImage(img image.Image, rect image.Rectangle) image.Image {
+	if sub, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(rect)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, rect.Min, draw.Src)
+	return dst
+}
+
+// cropWindow picks a width by height rectangle out of img
+func cropWindow(img image.Image, width int, height int, gravity string) image.Rectangle {
+	bounds := img.Bounds()
+	spareX, spareY := bounds.Dx()-width, bounds.Dy()-height
+	offsetX, offsetY := spareX/2, spareY/2
+	switch gravity {
+	case "top":
+		offsetY = 0
+	case "bottom":
+		offsetY = spareY
+	case "left":
+		offsetX = 0
+	case "right":
+		offsetX = spareX
+	case "entropy", "attention":
+		score := entropyScore
+		if gravity == "attention" {
+			score = attentionScore
+		}
+		offsetX, offsetY = bestWindow(img, width, height, score)
+	}
+	origin := bounds.Min.Add(image.Pt(offsetX, offsetY))
+	return image.Rectangle{Min: origin, Max: origin.Add(image.Pt(width, height))}
+}
+
+// bestWindow slides the window along whichever axis has room to spare,
+// returning the offset of the highest scoring position
+func bestWindow(img image.Image, width int, height int, score func(img image.Image, rect image.Rectangle) float64) (int, int) {
+	bounds := img.Bounds()
+	spareX, spareY := bounds.Dx()-width, bounds.Dy()-height
+	steps := 12
+	bestX, bestY, bestScore := spareX/2, spareY/2, -1.0
+	for i := 0; i <= steps; i++ {
+		x, y := spareX/2, spareY/2
+		if spareX > 0 {
+			x = spareX * i / steps
+		}
+		if spareY > 0 {
+			y = spareY * i / steps
+		}
+		origin := bounds.Min.Add(image.Pt(x, y))
+		s := score(img, image.Rectangle{Min: origin, Max: origin.Add(image.Pt(width, height))})
+		if s > bestScore {
+			bestX, bestY, bestScore = x, y, s
+		}
+		if spareX <= 0 && spareY <= 0 {
+			break
+		}
+	}
+	return bestX, bestY
+}
+
+// sampleStep keeps scoring cheap by only looking at some of the pixels
+func sampleStep(rect image.Rectangle) int {
+	return int(math.Max(1, math.Sqrt(float64(rect.Dx()*rect.Dy())/10000)))
+}
+
+func luminance(img image.Image, x int, y int) float64 {
+	r, g, b, _ := img.At(x, y).RGBA()
+	return (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 65535
+}
+
+// entropyScore is the shannon entropy of the luminance histogram, busy
+// detailed areas score higher than flat sky or walls
+func entropyScore(img image.Image, rect image.Rectangle) float64 {
+	histogram := [64]float64{}
+	total := 0.0
+	step := sampleStep(rect)
+	for y := rect.Min.Y; y < rect.Max.Y; y += step {
+		for x := rect.Min.X; x < rect.Max.X; x += step {
+			histogram[int(luminance(img, x, y)*63)]++
+			total++
+		}
+	}
+	entropy := 0.0
+	for _, count := range histogram {
+		if count > 0 {
+			p := count / total
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
+
+// attentionScore favours edges, saturated colour and skin tones, which is
+// roughly where people look first
+func attentionScore(img image.Image, rect image.Rectangle) float64 {
+	score := 0.0
+	step := sampleStep(rect)
+	for y := rect.Min.Y; y < rect.Max.Y-step; y += step {
+		for x := rect.Min.X; x < rect.Max.X-step; x += step {
+			lum := luminance(img, x, y)
+			edge := math.Abs(lum-luminance(img, x+step, y)) + math.Abs(lum-luminance(img, x, y+step))
+
+			r, g, b, _ := img.At(x, y).RGBA()
+			rf, gf, bf := float64(r)/65535, float64(g)/65535, float64(b)/65535
+			saturation := math.Max(rf, math.Max(gf, bf)) - math.Min(rf, math.Min(gf, bf))
+			skin := 0.0
+			if rf > 0.35 && rf > gf && gf > bf && rf-bf > 0.1 && rf-gf < 0.4 {
+				skin = 1
+			}
+			score += edge*4 + saturation + skin
+		}
+	}
+	return score
+}
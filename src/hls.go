@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+type hlsRendition struct {
+	Name         string
+	Height       int
+	VideoBitrate int
+	AudioBitrate int
+}
+
+var (
+	// HLS_RENDITIONS is the bitrate ladder, renditions taller than the
+	// source are left out apart from the smallest
+	HLS_RENDITIONS = []hlsRendition{
+		{"360p", 360, 800_000, 96_000},
+		{"720p", 720, 2_800_000, 128_000},
+		{"1080p", 1080, 5_000_000, 160_000},
+	}
+	HLS_SEGMENT_SECONDS = 6.0
+)
+
+// hlsVersion is part of the segment cache keys, so segments made with
+// older ffmpeg arguments are left to be evicted
+const hlsVersion = 2
+
+// HlsTranscoder turns any video ffmpeg can read into HLS, transcoding
+// segments as the player asks for them and keeping them in a cache
+type HlsTranscoder struct {
+	Cache *DiskCache
+
+	transcodes workLimiter
+	inFlight   flightGroup
+}
+
+func NewHlsTranscoder(cache *DiskCache, concurrency int) *HlsTranscoder {
+	return &HlsTranscoder{
+		Cache:      cache,
+		transcodes: newWorkLimiter(concurrency),
+	}
+}
+
+// hlsSource is what we need to know about a video to describe it as HLS
+type hlsSource struct {
+	path     string
+	info     fs.FileInfo
+	duration float64
+	width    int
+	height   int
+	hasAudio bool
+	// audio is the stream index of the audio track picked, -1 for the first
+	audio int
+}
+
+var errNoSuchAudio = errors.New("no such audio track")
+
+func readHlsSource(path string, query url.Values) (hlsSource, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return hlsSource{}, err
+	}
+	probe, err := readCachedProbe(path, info)
+	if err != nil {
+		return hlsSource{}, err
+	}
+	duration, err := probe.DurationSeconds()
+	if err != nil {
+		return hlsSource{}, err
+	}
+	audio, ok := audioStream(probe, query)
+	if !ok {
+		return hlsSource{}, errNoSuchAudio
+	}
+	source := hlsSource{path: path, info: info, duration: duration, audio: audio}
+	for _, stream := range probe.Streams {
+		if stream.CodecType == "video" && source.height == 0 {
+			source.width, source.height = stream.Width, stream.Height
+		}
+		if stream.CodecType == "audio" {
+			source.hasAudio = true
+		}
+	}
+	if source.height == 0 {
+		return hlsSource{}, fmt.Errorf("no video stream in %s", path)
+	}
+	return source, nil
+}
+
+func (source hlsSource) renditions() []hlsRendition {
+	renditions := []hlsRendition{}
+	for i, rendition := range HLS_RENDITIONS {
+		if i == 0 || rendition.Height <= source.height {
+			renditions = append(renditions, rendition)
+		}
+	}
+	return renditions
+}
+
+func (source hlsSource) rendition(name string) (hlsRendition, bool) {
+	for _, rendition := range source.renditions() {
+		if rendition.Name == name {
+			return rendition, true
+		}
+	}
+	return hlsRendition{}, false
+}
+
+func (source hlsSource) segmentCount() int {
+	return int(math.Max(1, math.Ceil(source.duration/HLS_SEGMENT_SECONDS)))
+}
+
+func (source hlsSource) segmentDuration(segment int) float64 {
+	return math.Min(HLS_SEGMENT_SECONDS, source.duration-float64(segment)*HLS_SEGMENT_SECONDS)
+}
+
+// scaledWidth keeps the aspect ratio, rounded to an even number for h264
+func (source hlsSource) scaledWidth(height int) int {
+	return int(math.Round(float64(source.width)*float64(height)/float64(source.height)/2)) * 2
+}
+
+// h264Levels are the H.264 levels renditions are encoded at, times ten,
+// with the most macroblocks a frame can have at each
+var h264Levels = []struct {
+	level       int
+	macroblocks int
+}{
+	{30, 1620},
+	{31, 3600},
+	{32, 5120},
+	{40, 8192},
+	{50, 22080},
+	{51, 36864},
+}
+
+// level is the lowest H.264 level, times ten, that allows a frame of the
+// rendition's size. 720p is 3.1 and 1080p is 4.0.
+func (source hlsSource) level(rendition hlsRendition) int {
+	width := (source.scaledWidth(rendition.Height) + 15) / 16
+	height := (rendition.Height + 15) / 16
+	for _, level := range h264Levels {
+		if width*height <= level.macroblocks {
+			return level.level
+		}
+	}
+	return h264Levels[len(h264Levels)-1].level
+}
+
+// audioQuery carries the audio track picked through the playlists
+func (source hlsSource) audioQuery() string {
+	if source.audio < 0 {
+		return ""
+	}
+	return fmt.Sprintf("&audio=%d", source.audio)
+}
+
+// MasterPlaylist lists a media playlist for each rendition
+func (source hlsSource) MasterPlaylist(baseUrl string) string {
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, rendition := range source.renditions() {
+		bandwidth := rendition.VideoBitrate
+		// high profile, at the rendition's level in hex
+		codecs := fmt.Sprintf("avc1.6400%02x", source.level(rendition))
+		if source.hasAudio {
+			bandwidth += rendition.AudioBitrate
+			codecs += ",mp4a.40.2"
+		}
+		fmt.Fprintf(&playlist, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,CODECS=\"%s\"\n%s?variant=%s%s\n",
+			bandwidth, source.scaledWidth(rendition.Height), rendition.Height, codecs, baseUrl, rendition.Name, source.audioQuery())
+	}
+	return playlist.String()
+}
+
+// MediaPlaylist lists every segment of a rendition up front, as we know
+// how long the video is
+func (source hlsSource) MediaPlaylist(baseUrl string, rendition hlsRendition) string {
+	var playlist strings.Builder
+	fmt.Fprintf(&playlist, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n",
+		int(math.Ceil(HLS_SEGMENT_SECONDS)))
+	for segment := 0; segment < source.segmentCount(); segment++ {
+		fmt.Fprintf(&playlist, "#EXTINF:%.3f,\n%s?variant=%s&segment=%d%s\n",
+			source.segmentDuration(segment), baseUrl, rendition.Name, segment, source.audioQuery())
+	}
+	playlist.WriteString("#EXT-X-ENDLIST\n")
+	return playlist.String()
+}
+
+// TranscodeSegment encodes one segment of a rendition as MPEG-TS. Segments
+// keep their place on the timeline so they play back to back.
+func TranscodeSegment(source hlsSource, rendition hlsRendition, segment int) ([]byte, error) {
+	start := float64(segment) * HLS_SEGMENT_SECONDS
+	outputArgs := ffmpeg.KwArgs{
+		"map":               []string{"0:v:0"},
+		"c:v":               "libx264",
+		"preset":            "veryfast",
+		"profile:v":         "high",
+		"level:v":           fmt.Sprintf("%.1f", float64(source.level(rendition))/10),
+		"pix_fmt":           "yuv420p",
+		"b:v":               strconv.Itoa(rendition.VideoBitrate),
+		"maxrate":           strconv.Itoa(rendition.VideoBitrate * 3 / 2),
+		"bufsize":           strconv.Itoa(rendition.VideoBitrate * 2),
+		"force_key_frames":  "expr:gte(t,0)",
+		"output_ts_offset":  fmt.Sprintf("%f", start),
+		"muxdelay":          "0",
+		"f":                 "mpegts",
+		"vf":                fmt.Sprintf("scale=%d:%d", source.scaledWidth(rendition.Height), rendition.Height),
+		"t":                 fmt.Sprintf("%f", source.segmentDuration(segment)),
+		"sn":                "",
+		"avoid_negative_ts": "disabled",
+	}
+	if source.hasAudio {
+		outputArgs["map"] = []string{"0:v:0", audioMap(source.audio)}
+		outputArgs["c:a"] = "aac"
+		outputArgs["b:a"] = strconv.Itoa(rendition.AudioBitrate)
+		outputArgs["ac"] = "2"
+	}
+	buf := bytes.NewBuffer(nil)
+	err := ffmpeg.Input(source.path, ffmpeg.KwArgs{"ss": fmt.Sprintf("%f", start)}).
+		Output("pipe:", outputArgs).
+		WithOutput(buf).
+		Run()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func hlsSegmentVariant(source hlsSource, rendition hlsRendition, segment int) string {
+	if source.audio >= 0 {
+		return fmt.Sprintf("hls-v%d-%s-a%d-%d", hlsVersion, rendition.Name, source.audio, segment)
+	}
+	return fmt.Sprintf("hls-v%d-%s-%d", hlsVersion, rendition.Name, segment)
+}
+
+// LoadSegment returns the segment from the cache, transcoding it if need
+// be, and gets the next one going so it's ready when the player asks
+func (t *HlsTranscoder) LoadSegment(ctx context.Context, source hlsSource, rendition hlsRendition, segment int) ([]byte, error) {
+	byts, err := t.loadSegment(ctx, source, rendition, segment)
+	if err == nil && segment+1 < source.segmentCount() {
+		go t.loadSegment(context.Background(), source, rendition, segment+1)
+	}
+	return byts, err
+}
+
+func (t *HlsTranscoder) loadSegment(ctx context.Context, source hlsSource, rendition hlsRendition, segment int) ([]byte, error) {
+	variant := hlsSegmentVariant(source, rendition, segment)
+	return t.inFlight.loadDerived(ctx, t.Cache, t.transcodes, source.path, source.info, variant, func() ([]byte, error) {
+		return TranscodeSegment(source, rendition, segment)
+	})
+}
+
+func (hdlr RequestHandlers) serveHls(w http.ResponseWriter, r *http.Request) {
+	mediaPath := strings.Replace(r.URL.Path, "/_hls", "", 1)
+	filepath := hdlr.MediaDirectory + mediaPath
+	prts := strings.Split(filepath, ".")
+	if !slices.Contains(videoExtensions, strings.ToLower(prts[len(prts)-1])) {
+		http.Error(w, "Not a video", http.StatusBadRequest)
+		return
+	}
+	source, err := readHlsSource(filepath, r.URL.Query())
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, errNoSuchAudio) {
+		http.Error(w, "No file found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println("Error reading video for hls:", err)
+		http.Error(w, "Error reading video", http.StatusInternalServerError)
+		return
+	}
+	baseUrl := (&url.URL{Path: "/_hls" + mediaPath}).EscapedPath()
+
+	query := r.URL.Query()
+	if query.Get("variant") == "" {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		http.ServeContent(w, r, "master.m3u8", source.info.ModTime(), strings.NewReader(source.MasterPlaylist(baseUrl)))
+		return
+	}
+	rendition, ok := source.rendition(query.Get("variant"))
+	if !ok {
+		http.Error(w, "No such variant", http.StatusNotFound)
+		return
+	}
+	if query.Get("segment") == "" {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		http.ServeContent(w, r, "media.m3u8", source.info.ModTime(), strings.NewReader(source.MediaPlaylist(baseUrl, rendition)))
+		return
+	}
+	segment, err := strconv.Atoi(query.Get("segment"))
+	if err != nil || segment < 0 || segment >= source.segmentCount() {
+		http.Error(w, "No such segment", http.StatusNotFound)
+		return
+	}
+	byts, err := hdlr.Transcoder.LoadSegment(r.Context(), source, rendition, segment)
+	if err != nil {
+		fmt.Println("Error transcoding hls segment:", err)
+		http.Error(w, "Error transcoding video", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp2t")
+	http.ServeContent(w, r, "segment.ts", source.info.ModTime(), bytes.NewReader(byts))
+}
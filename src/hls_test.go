@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHlsRenditionsNoTallerThanSource(t *testing.T) {
+	names := func(source hlsSource) []string {
+		found := []string{}
+		for _, rendition := range source.renditions() {
+			found = append(found, rendition.Name)
+		}
+		return found
+	}
+	hd := names(hlsSource{width: 1280, height: 720})
+	if strings.Join(hd, ",") != "360p,720p" {
+		t.Errorf("Expected 360p,720p, but got %v", hd)
+	}
+	// tiny videos still get something to play
+	tiny := names(hlsSource{width: 320, height: 240})
+	if strings.Join(tiny, ",") != "360p" {
+		t.Errorf("Expected 360p, but got %v", tiny)
+	}
+}
+
+func TestHlsMasterPlaylist(t *testing.T) {
+	source := hlsSource{width: 1920, height: 800, hasAudio: true, duration: 10, audio: -1}
+	playlist := source.MasterPlaylist("/_hls/a%20b.mkv")
+	expected := "#EXTM3U\n#EXT-X-VERSION:3\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=896000,RESOLUTION=864x360,CODECS=\"avc1.64001e,mp4a.40.2\"\n/_hls/a%20b.mkv?variant=360p\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2928000,RESOLUTION=1728x720,CODECS=\"avc1.640020,mp4a.40.2\"\n/_hls/a%20b.mkv?variant=720p\n"
+	if playlist != expected {
+		t.Errorf("Expected %q, but got %q", expected, playlist)
+	}
+}
+
+func TestHlsMasterPlaylistLevels(t *testing.T) {
+	source := hlsSource{width: 1920, height: 1080, duration: 10, audio: -1}
+	playlist := source.MasterPlaylist("/_hls/a.mp4")
+	for _, line := range []string{
+		"RESOLUTION=640x360,CODECS=\"avc1.64001e\"\n",
+		"RESOLUTION=1280x720,CODECS=\"avc1.64001f\"\n",
+		"RESOLUTION=1920x1080,CODECS=\"avc1.640028\"\n",
+	} {
+		if !strings.Contains(playlist, line) {
+			t.Errorf("Expected %q in %q", line, playlist)
+		}
+	}
+}
+
+func TestHlsMediaPlaylist(t *testing.T) {
+	source := hlsSource{width: 640, height: 360, duration: 14.5, audio: -1}
+	playlist := source.MediaPlaylist("/_hls/a.avi", HLS_RENDITIONS[0])
+	for _, line := range []string{
+		"#EXT-X-TARGETDURATION:6\n",
+		"#EXTINF:6.000,\n/_hls/a.avi?variant=360p&segment=0\n",
+		"#EXTINF:6.000,\n/_hls/a.avi?variant=360p&segment=1\n",
+		"#EXTINF:2.500,\n/_hls/a.avi?variant=360p&segment=2\n#EXT-X-ENDLIST\n",
+	} {
+		if !strings.Contains(playlist, line) {
+			t.Errorf("Expected %q in %q", line, playlist)
+		}
+	}
+	if strings.Contains(playlist, "segment=3") {
+		t.Errorf("Expected 3 segments, but got %q", playlist)
+	}
+}
+
+func TestHlsPlaylistsKeepAudioTrack(t *testing.T) {
+	source := hlsSource{width: 640, height: 360, duration: 5, hasAudio: true, audio: 2}
+	master := source.MasterPlaylist("/_hls/a.mkv")
+	if !strings.Contains(master, "/_hls/a.mkv?variant=360p&audio=2\n") {
+		t.Errorf("Expected the audio track in %q", master)
+	}
+	media := source.MediaPlaylist("/_hls/a.mkv", HLS_RENDITIONS[0])
+	if !strings.Contains(media, "/_hls/a.mkv?variant=360p&segment=0&audio=2\n") {
+		t.Errorf("Expected the audio track in %q", media)
+	}
+	if hlsSegmentVariant(source, HLS_RENDITIONS[0], 0) == hlsSegmentVariant(hlsSource{audio: -1}, HLS_RENDITIONS[0], 0) {
+		t.Errorf("Expected segments with different audio to be cached separately")
+	}
+}
@@ -0,0 +1,754 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// entries maps a media path to its IndexEntry, children keys are
+	// parent + "\x00" + name so a directory's contents are one cursor seek
+	// away, in name order
+	entriesBucket  = []byte("entries")
+	childrenBucket = []byte("children")
+	metaBucket     = []byte("meta")
+	lastScanKey    = []byte("lastScan")
+	versionKey     = []byte("version")
+)
+
+// indexVersion is stored with each entry, entries from another version
+// are extracted again on the next scan
+const indexVersion = 5
+
+// IndexEntry is everything the index knows about a file or directory.
+// Paths are relative to the media directory and start with a slash.
+type IndexEntry struct {
+	Path      string         `json:"path"`
+	Name      string         `json:"name"`
+	IsDir     bool           `json:"isDir"`
+	Type      string         `json:"type"`
+	Size      int64          `json:"size"`
+	ModTime   time.Time      `json:"modTime"`
+	FileCount int            `json:"fileCount,omitempty"`
+	Width     int            `json:"width,omitempty"`
+	Height    int            `json:"height,omitempty"`
+	Duration  float64        `json:"duration,omitempty"`
+	Metadata  *MediaMetadata `json:"metadata,omitempty"`
+	Version   int            `json:"version"`
+}
+
+// current is whether the entry still describes a file with this info
+func (entry IndexEntry) current(info fs.FileInfo) bool {
+	return entry.Version == indexVersion && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime())
+}
+
+// fileType is the gallery's idea of what a file is, from its extension
+func fileType(name string) string {
+	prts := strings.Split(name, ".")
+	ext := strings.ToLower(prts[len(prts)-1])
+	if slices.Contains(imageExtensions, ext) {
+		return "image"
+	}
+	if slices.Contains(videoExtensions, ext) {
+		return "video"
+	}
+	if slices.Contains(audioExtensions, ext) {
+		return "audio"
+	}
+	return "other"
+}
+
+// mediaPath tidies a url path into the form the index keys on
+func mediaPath(p string) string {
+	return pathpkg.Clean("/" + p)
+}
+
+func parentPath(p string) string {
+	return pathpkg.Dir(p)
+}
+
+func childKey(p string) []byte {
+	return []byte(parentPath(p) + "\x00" + pathpkg.Base(p))
+}
+
+// LibraryIndex is an on-disk index of the media directory, so listings and
+// searches don't have to go to the filesystem. A full scan keeps it in step
+// with the files, and listing a directory that has changed since it was
+// indexed re-reads that directory first.
+type LibraryIndex struct {
+	MediaDirectory string
+	Workers        int
+
+	db         *bolt.DB
+	scanMu     sync.Mutex
+	ready      atomic.Bool
+	generation atomic.Uint64
+
+	// files a listing found that are waiting on their metadata
+	enriching  sync.Map
+	background sync.WaitGroup
+	closing    chan struct{}
+}
+
+func OpenLibraryIndex(dbPath string, mediaDirectory string, workers int) (*LibraryIndex, error) {
+	err := os.MkdirAll(filepath.Dir(dbPath), 0755)
+	if err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(dbPath, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	idx := &LibraryIndex{MediaDirectory: mediaDirectory, Workers: workers, db: db, closing: make(chan struct{})}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{entriesBucket, childrenBucket, metaBucket, termsBucket, termLengthsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		// an index from a previous run is good enough to start with, as
+		// long as it was built by this version
+		meta := tx.Bucket(metaBucket)
+		version := string(meta.Get(versionKey)) == fmt.Sprint(indexVersion)
+		idx.ready.Store(version && meta.Get(lastScanKey) != nil)
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return idx, nil
+}
+
+// Close waits for background work to stop and closes the database. Cancel
+// the context given to Start first or it waits for the next scan to finish.
+func (idx *LibraryIndex) Close() error {
+	close(idx.closing)
+	idx.background.Wait()
+	return idx.db.Close()
+}
+
+// update writes to the index, anything derived from it can tell it's
+// changed by its Generation
+func (idx *LibraryIndex) update(fn func(tx *bolt.Tx) error) error {
+	defer idx.generation.Add(1)
+	return idx.db.Update(fn)
+}
+
+// Generation changes every time the index is written to
+func (idx *LibraryIndex) Generation() uint64 {
+	return idx.generation.Load()
+}
+
+func (idx *LibraryIndex) workerCount() int {
+	if idx.Workers < 1 {
+		return 1
+	}
+	return idx.Workers
+}
+
+// Ready is whether the index has been fully scanned at least once, until
+// then listings and searches should go to the filesystem
+func (idx *LibraryIndex) Ready() bool {
+	return idx != nil && idx.ready.Load()
+}
+
+// Start scans the library now and then every rescan, until ctx is done
+func (idx *LibraryIndex) Start(ctx context.Context, rescan time.Duration) {
+	idx.background.Add(1)
+	go func() {
+		defer idx.background.Done()
+		for {
+			started := time.Now()
+			err := idx.Scan(ctx)
+			if err != nil {
+				fmt.Printf("library scan stopped: %s\n", err)
+			} else {
+				fmt.Printf("library scan finished in %s\n", time.Since(started).Round(time.Second))
+			}
+			if rescan <= 0 {
+				return
+			}
+			select {
+			case <-time.After(rescan):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (idx *LibraryIndex) fullPath(p string) string {
+	return filepath.Join(idx.MediaDirectory, filepath.FromSlash(p))
+}
+
+// Get returns the entry for a media path
+func (idx *LibraryIndex) Get(p string) (IndexEntry, bool) {
+	var entry IndexEntry
+	found := false
+	idx.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(entriesBucket).Get([]byte(mediaPath(p)))
+		found = data != nil && json.Unmarshal(data, &entry) == nil
+		return nil
+	})
+	return entry, found
+}
+
+// List returns what's in a directory, in name order
+func (idx *LibraryIndex) List(p string) ([]IndexEntry, error) {
+	p = mediaPath(p)
+	info, err := os.Stat(idx.fullPath(p))
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", p)
+	}
+	if entry, ok := idx.Get(p); !ok || !entry.ModTime.Equal(info.ModTime()) {
+		// something's been added, removed or renamed since we last looked
+		err = idx.refreshDirectory(p, info)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	entries := []IndexEntry{}
+	err = idx.db.View(func(tx *bolt.Tx) error {
+		files := tx.Bucket(entriesBucket)
+		prefix := []byte(p + "\x00")
+		c := tx.Bucket(childrenBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			var entry IndexEntry
+			childPath := pathpkg.Join(p, string(k[len(prefix):]))
+			if json.Unmarshal(files.Get([]byte(childPath)), &entry) == nil {
+				entries = append(entries, entry)
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// Walk calls fn for every entry under root, not root itself, in path order
+func (idx *LibraryIndex) Walk(root string, fn func(entry IndexEntry) error) error {
+	root = mediaPath(root)
+	prefix := []byte(strings.TrimSuffix(root, "/") + "/")
+	return idx.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(entriesBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var entry IndexEntry
+			if string(k) == root || json.Unmarshal(v, &entry) != nil {
+				// the root isn't under itself
+				continue
+			}
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Refresh brings the index up to date for a single path, removing it and
+// anything under it if it's gone. It waits for a scan that's running, which
+// would otherwise drop anything it adds that the scan didn't see.
+func (idx *LibraryIndex) Refresh(p string) error {
+	idx.scanMu.Lock()
+	defer idx.scanMu.Unlock()
+	p = mediaPath(p)
+	info, err := os.Stat(idx.fullPath(p))
+	if errors.Is(err, fs.ErrNotExist) {
+		err = idx.update(func(tx *bolt.Tx) error {
+			return deleteTree(tx, p)
+		})
+		if err != nil {
+			return err
+		}
+		return idx.refreshParent(p)
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = idx.refreshDirectory(p, info)
+	} else {
+		err = idx.put(idx.readEntry(p, info))
+	}
+	if err != nil {
+		return err
+	}
+	return idx.refreshParent(p)
+}
+
+// refreshParent re-reads a directory after something in it changed, which
+// keeps its file count right
+func (idx *LibraryIndex) refreshParent(p string) error {
+	if p == "/" {
+		return nil
+	}
+	parent := parentPath(p)
+	info, err := os.Stat(idx.fullPath(parent))
+	if err != nil {
+		return nil
+	}
+	return idx.refreshDirectory(parent, info)
+}
+
+// refreshDirectory re-reads one directory without going into the
+// directories in it. New and changed files only get what a stat says about
+// them here, their metadata is read in the background by enrich.
+func (idx *LibraryIndex) refreshDirectory(p string, info fs.FileInfo) error {
+	children, err := os.ReadDir(idx.fullPath(p))
+	if err != nil {
+		return err
+	}
+	entries := []IndexEntry{}
+	unread := []IndexEntry{}
+	names := map[string]bool{}
+	for _, child := range children {
+		names[child.Name()] = true
+		childPath := pathpkg.Join(p, child.Name())
+		childInfo, err := child.Info()
+		if err != nil {
+			continue
+		}
+		existing, found := idx.Get(childPath)
+		if child.IsDir() {
+			if found && existing.ModTime.Equal(childInfo.ModTime()) {
+				continue
+			}
+			entry, err := idx.readDirectoryEntry(childPath, childInfo)
+			if err != nil {
+				continue
+			}
+			// only the count is fresh, its contents get read when it's listed
+			entry.ModTime = existing.ModTime
+			entries = append(entries, entry)
+			continue
+		}
+		if found && existing.current(childInfo) {
+			continue
+		}
+		entry := statEntry(childPath, childInfo)
+		entries = append(entries, entry)
+		unread = append(unread, entry)
+	}
+
+	dir := IndexEntry{
+		Path:      p,
+		Name:      pathpkg.Base(p),
+		IsDir:     true,
+		Type:      "directory",
+		ModTime:   info.ModTime(),
+		FileCount: len(children),
+		Version:   indexVersion,
+	}
+	err = idx.update(func(tx *bolt.Tx) error {
+		prefix := []byte(p + "\x00")
+		gone := []string{}
+		c := tx.Bucket(childrenBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			if name := string(k[len(prefix):]); !names[name] {
+				gone = append(gone, pathpkg.Join(p, name))
+			}
+		}
+		for _, gonePath := range gone {
+			if err := deleteTree(tx, gonePath); err != nil {
+				return err
+			}
+		}
+		for _, entry := range append(entries, dir) {
+			if err := putEntry(tx, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		idx.enrich(unread)
+	}
+	return err
+}
+
+// enrich reads the metadata of files that have only been stat'd, a few at a
+// time in the background, and upgrades their entries as it goes
+func (idx *LibraryIndex) enrich(entries []IndexEntry) {
+	queued := []IndexEntry{}
+	for _, entry := range entries {
+		if entry.Type == "other" {
+			continue
+		}
+		if _, busy := idx.enriching.LoadOrStore(entry.Path, true); !busy {
+			queued = append(queued, entry)
+		}
+	}
+	if len(queued) == 0 {
+		return
+	}
+	idx.background.Add(1)
+	go func() {
+		defer idx.background.Done()
+		jobs := make(chan IndexEntry)
+		var wg sync.WaitGroup
+		for i := 0; i < idx.workerCount(); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for entry := range jobs {
+					if err := idx.upgrade(entry); err != nil {
+						fmt.Printf("couldn't read %s: %s\n", entry.Path, err)
+					}
+					idx.enriching.Delete(entry.Path)
+				}
+			}()
+		}
+	queue:
+		for _, entry := range queued {
+			select {
+			case jobs <- entry:
+			case <-idx.closing:
+				break queue
+			}
+		}
+		close(jobs)
+		wg.Wait()
+		for _, entry := range queued {
+			idx.enriching.Delete(entry.Path)
+		}
+	}()
+}
+
+// upgrade replaces a stat'd entry with a fully read one, unless the file
+// has changed or gone in the meantime
+func (idx *LibraryIndex) upgrade(stat IndexEntry) error {
+	info, err := os.Stat(idx.fullPath(stat.Path))
+	if err != nil || info.Size() != stat.Size || !info.ModTime().Equal(stat.ModTime) {
+		return nil
+	}
+	entry := idx.readEntry(stat.Path, info)
+	return idx.update(func(tx *bolt.Tx) error {
+		var existing IndexEntry
+		data := tx.Bucket(entriesBucket).Get([]byte(stat.Path))
+		if data == nil || json.Unmarshal(data, &existing) != nil || existing.current(info) {
+			return nil
+		}
+		if existing.Size != stat.Size || !existing.ModTime.Equal(stat.ModTime) {
+			return nil
+		}
+		return putEntry(tx, entry)
+	})
+}
+
+func (idx *LibraryIndex) readDirectoryEntry(p string, info fs.FileInfo) (IndexEntry, error) {
+	children, err := os.ReadDir(idx.fullPath(p))
+	if err != nil {
+		return IndexEntry{}, err
+	}
+	return IndexEntry{
+		Path:      p,
+		Name:      pathpkg.Base(p),
+		IsDir:     true,
+		Type:      "directory",
+		ModTime:   info.ModTime(),
+		FileCount: len(children),
+		Version:   indexVersion,
+	}, nil
+}
+
+// statEntry describes a file from a stat alone. It has no version, so it
+// isn't current and its metadata gets read by enrich or the next scan.
+func statEntry(p string, info fs.FileInfo) IndexEntry {
+	entry := IndexEntry{
+		Path:    p,
+		Name:    pathpkg.Base(p),
+		Type:    fileType(p),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	if entry.Type == "other" {
+		// there's nothing more to read
+		entry.Version = indexVersion
+	}
+	return entry
+}
+
+// readEntry describes a file, reading its metadata
+func (idx *LibraryIndex) readEntry(p string, info fs.FileInfo) IndexEntry {
+	entry := statEntry(p, info)
+	entry.Version = indexVersion
+	if entry.Type == "other" {
+		return entry
+	}
+	full := idx.fullPath(p)
+	mtype, err := mimetype.DetectFile(full)
+	if err != nil {
+		return entry
+	}
+	metadata := readMediaMetadata(full, info, mtype.String())
+	if metadata.Video != nil {
+		entry.Duration = metadata.Video.Duration
+		// ffprobe's full output is large and easy to get again
+		metadata.Video.Probe = nil
+	}
+	entry.Width, entry.Height = metadata.Width, metadata.Height
+	entry.Metadata = metadata
+	return entry
+}
+
+func (idx *LibraryIndex) put(entry IndexEntry) error {
+	return idx.update(func(tx *bolt.Tx) error {
+		return putEntry(tx, entry)
+	})
+}
+
+func putEntry(tx *bolt.Tx, entry IndexEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	entries := tx.Bucket(entriesBucket)
+	if existing := entries.Get([]byte(entry.Path)); existing != nil {
+		err = unindexTerms(tx, existing)
+		if err != nil {
+			return err
+		}
+	}
+	err = entries.Put([]byte(entry.Path), data)
+	if err == nil {
+		err = indexTerms(tx, entry)
+	}
+	if err != nil || entry.Path == "/" {
+		return err
+	}
+	return tx.Bucket(childrenBucket).Put(childKey(entry.Path), nil)
+}
+
+// deleteTree removes an entry and everything under it
+func deleteTree(tx *bolt.Tx, p string) error {
+	entries := tx.Bucket(entriesBucket)
+	children := tx.Bucket(childrenBucket)
+	paths := [][]byte{[]byte(p)}
+	prefix := []byte(strings.TrimSuffix(p, "/") + "/")
+	c := entries.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		paths = append(paths, append([]byte{}, k...))
+	}
+	for _, key := range paths {
+		if existing := entries.Get(key); existing != nil {
+			if err := unindexTerms(tx, existing); err != nil {
+				return err
+			}
+		}
+		if err := entries.Delete(key); err != nil {
+			return err
+		}
+		if string(key) == "/" {
+			continue
+		}
+		if err := children.Delete(childKey(string(key))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scan walks the whole media directory, reading anything new or changed
+// and dropping anything that's gone. Only one scan runs at a time.
+func (idx *LibraryIndex) Scan(ctx context.Context) error {
+	idx.scanMu.Lock()
+	defer idx.scanMu.Unlock()
+
+	type job struct {
+		path string
+		info fs.FileInfo
+	}
+	jobs := make(chan job)
+	results := make(chan IndexEntry)
+	var wg sync.WaitGroup
+	for i := 0; i < idx.workerCount(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				results <- idx.readEntry(j.path, j.info)
+			}
+		}()
+	}
+
+	// entries are written in batches, a transaction each is slow
+	written := make(chan error, 1)
+	go func() {
+		batch := []IndexEntry{}
+		var err error
+		flush := func() {
+			if len(batch) == 0 || err != nil {
+				return
+			}
+			err = idx.update(func(tx *bolt.Tx) error {
+				for _, entry := range batch {
+					if err := putEntry(tx, entry); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			batch = batch[:0]
+		}
+		for entry := range results {
+			batch = append(batch, entry)
+			if len(batch) >= 100 {
+				flush()
+			}
+		}
+		flush()
+		written <- err
+	}()
+
+	seen := map[string]bool{}
+	unreadable := []string{}
+	directories := []IndexEntry{}
+	walkErr := filepath.WalkDir(idx.MediaDirectory, func(full string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// unreadable, leave whatever we knew about it and anything
+			// under it alone
+			if rel, relErr := filepath.Rel(idx.MediaDirectory, full); relErr == nil {
+				p := mediaPath(filepath.ToSlash(rel))
+				seen[p] = true
+				unreadable = append(unreadable, strings.TrimSuffix(p, "/")+"/")
+			}
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, err := filepath.Rel(idx.MediaDirectory, full)
+		if err != nil {
+			return nil
+		}
+		p := mediaPath(filepath.ToSlash(rel))
+		seen[p] = true
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			entry, err := idx.readDirectoryEntry(p, info)
+			if err == nil {
+				directories = append(directories, entry)
+			}
+			return nil
+		}
+		if existing, found := idx.Get(p); found && existing.current(info) {
+			return nil
+		}
+		select {
+		case jobs <- job{p, info}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		return nil
+	})
+	close(jobs)
+	wg.Wait()
+	close(results)
+	err := <-written
+	if walkErr != nil {
+		return walkErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return idx.update(func(tx *bolt.Tx) error {
+		for _, dir := range directories {
+			if err := putEntry(tx, dir); err != nil {
+				return err
+			}
+		}
+		gone := []string{}
+		c := tx.Bucket(entriesBucket).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			p := string(k)
+			underUnreadable := slices.ContainsFunc(unreadable, func(prefix string) bool {
+				return strings.HasPrefix(p, prefix)
+			})
+			if !seen[p] && !underUnreadable {
+				gone = append(gone, p)
+			}
+		}
+		for _, p := range gone {
+			if err := deleteTree(tx, p); err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket(metaBucket)
+		err := meta.Put(lastScanKey, []byte(time.Now().Format(time.RFC3339)))
+		if err == nil {
+			err = meta.Put(versionKey, []byte(fmt.Sprint(indexVersion)))
+		}
+		if err == nil {
+			idx.ready.Store(true)
+		}
+		return err
+	})
+}
+
+// listDirectory is what's in a gallery directory, from the index once it's
+// been scanned and from the filesystem until then
+func (hdlr RequestHandlers) listDirectory(path string, requestDir string) ([]IndexEntry, error) {
+	if hdlr.Index.Ready() {
+		return hdlr.Index.List(path)
+	}
+	files, err := hdlr.ReadDir(requestDir)
+	if err != nil {
+		return nil, err
+	}
+	entries := []IndexEntry{}
+	for _, file := range files {
+		entry := IndexEntry{
+			Path: pathpkg.Join(mediaPath(path), file.Name()),
+			Name: file.Name(),
+			Type: fileType(file.Name()),
+		}
+		if file.IsDir() {
+			subdir, err := hdlr.ReadDir(fmt.Sprintf("%s/%s", requestDir, file.Name()))
+			if err != nil {
+				continue
+			}
+			entry.IsDir = true
+			entry.Type = "directory"
+			entry.FileCount = len(subdir)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// newIndexedGalleryFileData is a gallery tile for an entry, with the
+// duration and resolution of videos if they've been indexed
+func newIndexedGalleryFileData(entry IndexEntry) GalleryFileData {
+	file := newGalleryFileData(entry.Name, entry.Path, "/_thumbnail"+entry.Path)
+	if entry.Duration > 0 {
+		file.Duration = formatDuration(entry.Duration)
+		file.Resolution = resolutionLabel(entry.Width, entry.Height)
+	}
+	return file
+}
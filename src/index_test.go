@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"image"
+	"image/png"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestPng(t *testing.T, path string, width int, height int) {
+	t.Helper()
+	os.MkdirAll(filepath.Dir(path), 0755)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	png.Encode(f, image.NewRGBA(image.Rect(0, 0, width, height)))
+}
+
+func openTestIndex(t *testing.T, mediaDir string) *LibraryIndex {
+	t.Helper()
+	idx, err := OpenLibraryIndex(filepath.Join(t.TempDir(), "library.db"), mediaDir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { idx.Close() })
+	return idx
+}
+
+func TestLibraryIndexScan(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPng(t, filepath.Join(dir, "holidays", "beach.png"), 40, 30)
+	writeTestPng(t, filepath.Join(dir, "holidays", "cliffs.png"), 10, 10)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("hello"), 0644)
+	idx := openTestIndex(t, dir)
+	if idx.Ready() {
+		t.Errorf("Expected a new index not to be ready")
+	}
+	if err := idx.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !idx.Ready() {
+		t.Errorf("Expected the index to be ready after a scan")
+	}
+
+	entries, err := idx.List("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name != "holidays" || entries[0].FileCount != 2 || entries[1].Type != "other" {
+		t.Errorf("Expected holidays and notes.txt, but got %+v", entries)
+	}
+	beach, found := idx.Get("/holidays/beach.png")
+	if !found || beach.Type != "image" || beach.Width != 40 || beach.Height != 30 || beach.Metadata == nil {
+		t.Errorf("Expected a 40x30 image, but got %+v", beach)
+	}
+
+	os.Remove(filepath.Join(dir, "holidays", "cliffs.png"))
+	if err := idx.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := idx.Get("/holidays/cliffs.png"); found {
+		t.Errorf("Expected removed files to leave the index")
+	}
+	entries, _ = idx.List("/holidays")
+	if len(entries) != 1 || entries[0].Name != "beach.png" {
+		t.Errorf("Expected only beach.png, but got %+v", entries)
+	}
+}
+
+func TestLibraryIndexListNoticesChanges(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPng(t, filepath.Join(dir, "a.png"), 10, 10)
+	idx := openTestIndex(t, dir)
+	if err := idx.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	writeTestPng(t, filepath.Join(dir, "b.png"), 20, 10)
+	writeTestPng(t, filepath.Join(dir, "new", "c.png"), 10, 10)
+	// some filesystems only keep mtimes to the second
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(dir, later, later)
+
+	entries, err := idx.List("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	if strings.Join(names, ",") != "a.png,b.png,new" {
+		t.Errorf("Expected a.png,b.png,new, but got %v", names)
+	}
+	entries, err = idx.List("/new")
+	if err != nil || len(entries) != 1 || entries[0].Name != "c.png" {
+		t.Errorf("Expected c.png to be listed with its directory, but got %+v %v", entries, err)
+	}
+	waitFor(t, "c.png's metadata to be read in the background", func() bool {
+		entry, found := idx.Get("/new/c.png")
+		return found && entry.Width == 10 && entry.Metadata != nil
+	})
+}
+
+func TestLibraryIndexScanKeepsUnreadableDirectories(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPng(t, filepath.Join(dir, "locked", "a.png"), 10, 10)
+	writeTestPng(t, filepath.Join(dir, "locked", "deeper", "b.png"), 10, 10)
+	idx := openTestIndex(t, dir)
+	if err := idx.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	locked := filepath.Join(dir, "locked")
+	os.Chmod(locked, 0)
+	t.Cleanup(func() { os.Chmod(locked, 0755) })
+	if _, err := os.ReadDir(locked); err == nil {
+		t.Skip("permissions aren't enforced for this user")
+	}
+	if err := idx.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/locked", "/locked/a.png", "/locked/deeper/b.png"} {
+		if _, found := idx.Get(p); !found {
+			t.Errorf("Expected %s to stay in the index while it can't be read", p)
+		}
+	}
+	if len(idx.Candidates("/", []string{"deeper"})) == 0 {
+		t.Errorf("Expected the search terms under it to stay too")
+	}
+}
+
+func TestLibraryIndexWalkSkipsRoot(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPng(t, filepath.Join(dir, "trips", "beans.png"), 10, 10)
+	idx := openTestIndex(t, dir)
+	if err := idx.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{}
+	idx.Walk("/", func(entry IndexEntry) error {
+		paths = append(paths, entry.Path)
+		return nil
+	})
+	if strings.Join(paths, ",") != "/trips,/trips/beans.png" {
+		t.Errorf("Expected /trips,/trips/beans.png, but got %v", paths)
+	}
+	query, _ := parseQuery("type:directory")
+	results, _ := RequestHandlers{MediaDirectory: dir, Index: idx}.search("/", dir, query)
+	if len(results) != 1 || results[0].Path != "/trips" {
+		t.Errorf("Expected only /trips, but got %+v", results)
+	}
+}
+
+func TestLibraryIndexRefresh(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPng(t, filepath.Join(dir, "old", "a.png"), 10, 10)
+	idx := openTestIndex(t, dir)
+	if err := idx.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(filepath.Join(dir, "old"))
+	if err := idx.Refresh("/old"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := idx.Get("/old/a.png"); found {
+		t.Errorf("Expected a removed directory's files to leave the index")
+	}
+}
+
+func TestSearchUsesIndex(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPng(t, filepath.Join(dir, "trips", "Beach.png"), 10, 10)
+	writeTestPng(t, filepath.Join(dir, "trips", "forest.png"), 10, 10)
+	idx := openTestIndex(t, dir)
+	if err := idx.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	templates := template.Must(template.New("").Parse(`{{ define "baseHTML" }}{{ range .GalleryData.Files }}{{ .Link }} {{ end }}{{ end }}`))
+	hdlr := RequestHandlers{MediaDirectory: dir, Templates: templates, Index: idx}
+	rec := httptest.NewRecorder()
+	hdlr.performSearch(rec, httptest.NewRequest("GET", "/_search/?query=beach", nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, "/trips/Beach.png") || strings.Contains(body, "forest.png") {
+		t.Errorf("Expected only Beach.png in the results, but got %s", body)
+	}
+}
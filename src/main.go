@@ -1,17 +1,11 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
-	"image"
-	"image/gif"
-	"image/jpeg"
-	"image/png"
-	"io"
 	"io/fs"
 	"math"
 	"net/http"
@@ -19,16 +13,16 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
 	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/gabriel-vasile/mimetype"
-	"github.com/nfnt/resize"
 	ffmpeg "github.com/u2takey/ffmpeg-go"
-	"golang.org/x/image/bmp"
 )
 
 type GalleryDirectoryData struct {
@@ -39,20 +33,86 @@ type GalleryDirectoryData struct {
 
 type GalleryFileData struct {
 	Name, Link, Thumbnail string
+	Thumbnails            []ThumbnailSize
+	// Preview is an animated version to play on hover, if there is one
+	Preview string
+	IsVideo bool
+	// Duration and Resolution are only known for videos ffprobe can read
+	Duration   string
+	Resolution string
+}
+
+type ThumbnailSize struct {
+	Width uint
+	URL   string
+}
+
+func newGalleryFileData(name string, link string, thumbnail string) GalleryFileData {
+	sizes := []ThumbnailSize{}
+	for _, width := range galleryThumbnailWidths {
+		sizes = append(sizes, ThumbnailSize{Width: width, URL: galleryThumbnailURL(thumbnail, width)})
+	}
+	preview := ""
+	prts := strings.Split(name, ".")
+	ext := strings.ToLower(prts[len(prts)-1])
+	if hasAnimatedPreview(ext) {
+		preview = strings.Replace(thumbnail, "/_thumbnail", "/_preview", 1)
+	}
+	return GalleryFileData{
+		Name:       name,
+		Link:       link,
+		Thumbnail:  thumbnail,
+		Thumbnails: sizes,
+		Preview:    preview,
+		IsVideo:    slices.Contains(videoExtensions, ext),
+	}
+}
+
+// ThumbnailAt is the tile's thumbnail at one width, for browsers that don't
+// understand srcset
+func (file GalleryFileData) ThumbnailAt(width uint) string {
+	return galleryThumbnailURL(file.Thumbnail, width)
+}
+
+func galleryThumbnailURL(thumbnail string, width uint) string {
+	return (&url.URL{Path: thumbnail}).EscapedPath() + "?" + galleryThumbnailOptions(width).query().Encode()
+}
+
+// Srcset lets the browser pick whichever thumbnail suits the screen
+func (file GalleryFileData) Srcset() template.Srcset {
+	candidates := []string{}
+	for _, size := range file.Thumbnails {
+		candidates = append(candidates, fmt.Sprintf("%s %dw", size.URL, size.Width))
+	}
+	return template.Srcset(strings.Join(candidates, ", "))
 }
 
 type GalleryData struct {
-	HasDirectories bool
-	Directories    []GalleryDirectoryData
-	Files          []GalleryFileData
-	VisibleTypes   []string
-	AvailableTypes []string
-	Query          string
-	PageNumber     int
-	NextPage       int //blame templates
-	PageLength     int
-	URL            string
-	HasMore        bool
+	HasDirectories      bool
+	Directories         []GalleryDirectoryData
+	Files               []GalleryFileData
+	VisibleTypes        []string
+	AvailableTypes      []string
+	VisibleExtensions   []string
+	AvailableExtensions []string
+	Query               string
+	PageNumber          int
+	NextPage            int //blame templates
+	PageLength          int
+	URL                 string
+	HasMore             bool
+	// QueryError is what's wrong with the search, if it couldn't be run
+	QueryError  string
+	Sorting     Sorting
+	SortOptions []SortOption
+}
+
+// NextPageURL loads the next page of the gallery in the same order, with
+// the same filters
+func (gallery GalleryData) NextPageURL() string {
+	values := gallery.pageValues()
+	values.Set("pageNum", strconv.Itoa(gallery.NextPage))
+	return gallery.URL + "?" + values.Encode()
 }
 
 var (
@@ -61,11 +121,19 @@ var (
 )
 
 type FileData struct {
-	URL                 string
-	RawPath             string
-	IsImage             bool
-	IsVideo             bool
-	IsStreamable        bool
+	URL          string
+	RawPath      string
+	IsImage      bool
+	IsVideo      bool
+	IsStreamable bool
+	// StreamSource is what the player loads, the file itself if browsers
+	// can play it, a remux of it or an hls playlist transcoded from it
+	PlaybackMode        string
+	StreamSource        string
+	StreamType          string
+	Subtitles           []SubtitleTrack
+	AudioTracks         []AudioTrack
+	Metadata            *MediaMetadata
 	VideoDuration       float64
 	VideoDurationPretty string
 	FileType            string
@@ -83,14 +151,20 @@ type PageData struct {
 	URL            string
 	GalleryData    *GalleryData
 	FileData       *FileData
+	TimelineData   *TimelineData
 }
 
 type RequestHandlers struct {
-	MediaDirectory string
-	Stat           func(name string) (fs.FileInfo, error)
-	ReadDir        func(name string) ([]fs.DirEntry, error)
-	Templates      *template.Template
-	DetectFile     func(path string) (*mimetype.MIME, error)
+	MediaDirectory  string
+	Stat            func(name string) (fs.FileInfo, error)
+	ReadDir         func(name string) ([]fs.DirEntry, error)
+	Templates       *template.Template
+	DetectFile      func(path string) (*mimetype.MIME, error)
+	Thumbnailer     *Thumbnailer
+	ThumbnailWarmer *ThumbnailWarmer
+	Transcoder      *HlsTranscoder
+	Streams         *StreamTracker
+	Index           *LibraryIndex
 }
 
 func (hdlr RequestHandlers) serveFile(w http.ResponseWriter, r *http.Request, f *os.File) {
@@ -122,146 +196,8 @@ var videoExtensions []string = []string{
 	"mp4", "avi", "mkv", "mov", "wmv", "flv", "webm", "mpeg", "mpg", "3gp",
 }
 
-func ReadPreviewFrameAsJpeg(inFileName string) ([]byte, error) {
-
-	dt, err := ffmpeg.Probe(inFileName)
-	if err != nil {
-		return []byte{}, err
-	}
-	var metadata FFMpegProbe
-	err = json.Unmarshal([]byte(dt), &metadata)
-	if err != nil {
-		return []byte{}, err
-	}
-	frame := 0      // fallback to first frame
-	maxFrame := 600 // we need a limit as ffmpeg might try and read the whole damn file
-	for _, stream := range metadata.Streams {
-		if stream.CodecType == "video" {
-			// find our center frame
-			pts := strings.Split(stream.AverageFrameRate, "/")
-			fr, err := strconv.Atoi(pts[0])
-			if err == nil {
-				dur, err := strconv.ParseFloat(metadata.Format.Duration, 64)
-				if err == nil {
-					frame = (int(dur) / 2) * fr
-					frame = int(math.Min(float64(frame), float64(maxFrame)))
-				}
-			}
-
-			break
-		}
-	}
-	buf := bytes.NewBuffer(nil)
-	err = ffmpeg.Input(inFileName).
-		Filter("select", ffmpeg.Args{fmt.Sprintf("gte(n,%d)", frame)}).
-		Output("pipe:", ffmpeg.KwArgs{"vframes": 1, "format": "image2", "vcodec": "mjpeg"}).
-		WithOutput(buf).
-		Run()
-	if err != nil {
-		return []byte{}, err
-	}
-	return buf.Bytes(), nil
-}
-
-func (hdlr RequestHandlers) getThumbnail(w http.ResponseWriter, r *http.Request) {
-	filepath := r.URL.Path
-	rawWidth := r.URL.Query().Get("width")
-	var width uint
-	iwidth, err := strconv.Atoi(rawWidth)
-	if rawWidth == "" || err != nil {
-		iwidth = 300
-	}
-	width = uint(iwidth)
-	filepath = strings.Replace(filepath, "/_thumbnail", hdlr.MediaDirectory, 1)
-	file, err := os.Open(filepath)
-	if err != nil {
-		http.Error(w, "No file found", http.StatusNotFound)
-		return
-	}
-	prts := strings.Split(filepath, ".")
-	ext := strings.ToLower(prts[len(prts)-1])
-	defer file.Close()
-	if slices.Contains(imageExtensions, ext) {
-		var img image.Image
-		var err error
-		fileContents, err := io.ReadAll(file)
-		if err != nil {
-			fmt.Println("Error reading file:", err)
-			return
-		}
-
-		mtype := mimetype.Detect(fileContents)
-		if !strings.HasPrefix(mtype.String(), "image/") {
-			fmt.Println("Not recognised as image")
-			return
-		}
-
-		imgFormat := strings.Split(mtype.String(), "/")[1]
-
-		switch imgFormat {
-		case "jpeg":
-			img, err = jpeg.Decode(bytes.NewReader(fileContents))
-		case "bmp":
-			img, err = bmp.Decode(bytes.NewReader(fileContents))
-		case "png":
-			img, err = png.Decode(bytes.NewReader(fileContents))
-		case "gif":
-			img, err = gif.Decode(bytes.NewReader(fileContents))
-		// Add more cases for other image formats if needed
-		default:
-			err = fmt.Errorf("unsupported image format: %s", mtype.String())
-		}
-		if err != nil {
-			return
-		}
-		st, err := file.Stat()
-
-		imgResized := resize.Resize(width, 0, img, resize.Bilinear)
-		var buf bytes.Buffer
-		var imgErr error
-		switch imgFormat {
-		case "jpeg":
-			imgErr = jpeg.Encode(&buf, imgResized, nil)
-		case "bmp":
-			imgErr = bmp.Encode(&buf, imgResized)
-		case "png":
-			imgErr = png.Encode(&buf, imgResized)
-		case "gif":
-			imgErr = gif.Encode(&buf, imgResized, nil)
-		// Add more cases for other image formats if needed
-		default:
-			imgErr = fmt.Errorf("unsupported image format: %s", mtype.String())
-		}
-		if imgErr != nil {
-			return
-		}
-		http.ServeContent(w, r, st.Name(), st.ModTime(), bytes.NewReader(buf.Bytes()))
-		return
-	}
-	if slices.Contains(videoExtensions, ext) {
-		byts, err := ReadPreviewFrameAsJpeg(filepath)
-		if err != nil {
-			file, err := os.Open("./static/play.png")
-			defer file.Close()
-			if err != nil {
-				http.Error(w, "No file found", http.StatusNotFound)
-				return
-			}
-			hdlr.serveFile(w, r, file)
-			return
-		}
-		st, err := file.Stat()
-		http.ServeContent(w, r, st.Name(), st.ModTime(), bytes.NewReader(byts))
-		return
-	}
-	file, err = os.Open("./static/picture.png")
-	if err != nil {
-		http.Error(w, "No file found", http.StatusNotFound)
-		return
-	}
-	defer file.Close()
-	hdlr.serveFile(w, r, file)
-	return
+var audioExtensions []string = []string{
+	"mp3", "flac", "wav", "m4a", "aac", "ogg", "opus", "wma",
 }
 
 func (hdlr RequestHandlers) getStaticFile(w http.ResponseWriter, r *http.Request) {
@@ -319,10 +255,23 @@ func (hdlr RequestHandlers) getPageData(path string, query url.Values, pageNum i
 	checkFile, err := hdlr.Stat(requestDir)
 
 	if errors.Is(err, os.ErrNotExist) || checkFile.IsDir() {
-		files, err := hdlr.ReadDir(requestDir)
+		files, err := hdlr.listDirectory(path, requestDir)
 		if err != nil {
 			return nil
 		}
+		files = hidePosterSidecars(files)
+		sortOptions := availableSortOptions(hdlr.Index.Ready(), false)
+		sorting := readSorting(query, sortOptions)
+		if sorting.needsStat() && !hdlr.Index.Ready() {
+			for i := range files {
+				if info, err := hdlr.Stat(fmt.Sprintf("%s/%s", requestDir, files[i].Name)); err == nil {
+					files[i].Size, files[i].ModTime = info.Size(), info.ModTime()
+				}
+			}
+		}
+		sortEntries(files, sorting)
+		filter := readTypeFilter(query)
+		files, availableTypes, availableExtensions := filterFiles(files, filter)
 		directories := []GalleryDirectoryData{}
 		galleryFiles := []GalleryFileData{}
 
@@ -331,78 +280,39 @@ func (hdlr RequestHandlers) getPageData(path string, query url.Values, pageNum i
 			rooting = ""
 		}
 
-		visibleTypes := []string{}
-		availableMap := map[string]bool{}
-
-		visible := query["visible"]
-
-		isFiltering := len(visible) > 0
-
 		for _, file := range files {
-			if file.IsDir() {
-				subdir, err := hdlr.ReadDir(fmt.Sprintf("%s/%s", requestDir, file.Name()))
-				if err != nil {
-					continue
-				}
+			if file.IsDir {
 				directories = append(directories, GalleryDirectoryData{
-					Name:      file.Name(),
-					Link:      fmt.Sprintf("%s/%s", rooting, file.Name()),
-					FileCount: len(subdir),
+					Name:      file.Name,
+					Link:      fmt.Sprintf("%s/%s", rooting, file.Name),
+					FileCount: file.FileCount,
 				})
 				continue
 			}
-			prts := strings.Split(file.Name(), ".")
-			ext := strings.ToLower(prts[len(prts)-1])
-			if slices.Contains(imageExtensions, ext) {
-				availableMap["image"] = true
-				if isFiltering && !slices.Contains(visible, "image") {
-					continue
-				}
-			}
-			if slices.Contains(videoExtensions, ext) {
-				availableMap["video"] = true
-				if isFiltering && !slices.Contains(visible, "video") {
-					continue
-				}
-			}
-			if !slices.Contains(imageExtensions, ext) && !slices.Contains(videoExtensions, ext) {
-				availableMap["other"] = true
-				if isFiltering && !slices.Contains(visible, "other") {
-					continue
-				}
-			}
-			extraSlash := ""
-			if path != "/" {
-				extraSlash = "/"
-			}
-			galleryFiles = append(galleryFiles, GalleryFileData{
-				Name:      file.Name(),
-				Link:      fmt.Sprintf("%s/%s", rooting, file.Name()),
-				Thumbnail: fmt.Sprintf("/_thumbnail%s%s%s", path, extraSlash, file.Name()),
-			})
+			galleryFiles = append(galleryFiles, newIndexedGalleryFileData(file))
 		}
 
-		availableTypes := []string{}
-		for k, v := range availableMap {
-			if v {
-				availableTypes = append(availableTypes, k)
-			}
-		}
-		sort.SliceStable(availableTypes, func(i, j int) bool {
-			return availableTypes[i] > availableTypes[j]
+		// folders always go by name, whatever the files are sorted by
+		sort.SliceStable(directories, func(i, j int) bool {
+			return naturalLess(directories[i].Name, directories[j].Name)
 		})
 
 		data.GalleryData = &GalleryData{
-			HasDirectories: len(directories) > 0,
-			Directories:    directories,
-			VisibleTypes:   visibleTypes,
-			AvailableTypes: availableTypes,
+			HasDirectories:      len(directories) > 0,
+			Directories:         directories,
+			VisibleTypes:        filter.Types,
+			AvailableTypes:      availableTypes,
+			VisibleExtensions:   filter.Extensions,
+			AvailableExtensions: availableExtensions,
+			Sorting:             sorting,
+			SortOptions:         sortOptions,
 		}
 		start := (pageNum - 1) * pageLen
 		data.GalleryData.Files = galleryFiles[(pageNum-1)*pageLen : int(math.Min(float64(start+pageLen), float64(len(galleryFiles))))]
 		data.GalleryData.URL = path
 		data.GalleryData.NextPage = pageNum + 1
 		data.GalleryData.HasMore = start+pageLen < len(galleryFiles)
+		hdlr.addVideoDetails(data.GalleryData.Files)
 		data.ShowGallery = true
 	} else {
 		data.ShowGallery = false
@@ -416,42 +326,96 @@ func (hdlr RequestHandlers) getPageData(path string, query url.Values, pageNum i
 			FileType:     ftype,
 			URL:          path,
 		}
-		if data.FileData.IsVideo {
-			dt, _ := ffmpeg.Probe(requestDir)
-			var metadata FFMpegProbe
-			err := json.Unmarshal([]byte(dt), &metadata)
-			if err != nil {
-				return &data
-			}
-
-			dur, err := strconv.ParseFloat(metadata.Format.Duration, 64)
-			if err != nil {
-				return &data
-			}
-
-			minutes := int(dur / 60)
-			remainderSeconds := int(int(dur) % 60)
-
+		if !data.FileData.IsVideo {
+			data.FileData.Metadata = readMediaMetadata(requestDir, checkFile, ftype)
+			return &data
+		}
+		// everything about playing it comes from the one probe
+		probe, err := readCachedProbe(requestDir, checkFile)
+		if err != nil {
+			fmt.Printf("couldn't probe %s: %s\n", path, err)
+			data.FileData.Metadata = &MediaMetadata{Type: ftype, Size: checkFile.Size(), Modified: checkFile.ModTime()}
+		} else {
+			data.FileData.Metadata = probedMediaMetadata(checkFile, ftype, probe)
+		}
+		data.FileData.PlaybackMode = playbackMode(path, probe)
+		data.FileData.StreamSource, data.FileData.StreamType = streamSource(path, ftype, data.FileData.PlaybackMode)
+		data.FileData.Subtitles = subtitleTracks(path, requestDir, probe)
+		data.FileData.AudioTracks = audioTracks(path, probe, data.FileData.StreamSource, data.FileData.StreamType, data.FileData.PlaybackMode)
+		if dur, err := probe.DurationSeconds(); err == nil {
 			data.FileData.VideoDuration = dur
-			data.FileData.VideoDurationPretty = fmt.Sprintf("%d:%d", minutes, remainderSeconds)
+			data.FileData.VideoDurationPretty = formatDuration(dur)
 		}
 	}
 	return &data
 }
 
 type FFMPegProbeFormat struct {
-	Duration string `json:"duration"`
-	BitRate  string `json:"bit_rate"`
+	Duration       string `json:"duration"`
+	BitRate        string `json:"bit_rate"`
+	FormatLongName string `json:"format_long_name"` // Matroska / WebM
+}
+
+type FFMPegStreamTags struct {
+	Language string `json:"language"` // eng, fre
+	Title    string `json:"title"`
 }
 
 type FFMPegStreamFormat struct {
-	CodecType        string `json:"codec_type"`     //video, audio
-	AverageFrameRate string `json:"avg_frame_rate"` // 24/1
+	Index            int              `json:"index"`
+	CodecType        string           `json:"codec_type"`     //video, audio
+	CodecName        string           `json:"codec_name"`     // h264, aac
+	PixelFormat      string           `json:"pix_fmt"`        // yuv420p
+	AverageFrameRate string           `json:"avg_frame_rate"` // 24/1
+	Width            int              `json:"width"`
+	Height           int              `json:"height"`
+	BitRate          string           `json:"bit_rate"`
+	Channels         int              `json:"channels"`
+	ChannelLayout    string           `json:"channel_layout"` // 5.1(side)
+	SampleRate       string           `json:"sample_rate"`
+	Tags             FFMPegStreamTags `json:"tags"`
 }
 
 type FFMpegProbe struct {
 	Format  FFMPegProbeFormat `json:"format"`
 	Streams []FFMPegStreamFormat
+	// Raw is everything ffprobe had to say
+	Raw json.RawMessage `json:"-"`
+}
+
+func readProbe(path string) (FFMpegProbe, error) {
+	var metadata FFMpegProbe
+	dt, err := ffmpeg.Probe(path)
+	if err != nil {
+		return metadata, err
+	}
+	err = json.Unmarshal([]byte(dt), &metadata)
+	metadata.Raw = json.RawMessage(dt)
+	return metadata, err
+}
+
+// PROBE_CACHE_ENTRIES is how many files' ffprobe output is kept in memory
+var PROBE_CACHE_ENTRIES = 256
+
+// probes remembers readProbe results by file version, the hls playlists and
+// every segment need them and ffprobe isn't free
+var probes = newMemoryCache[FFMpegProbe](PROBE_CACHE_ENTRIES)
+
+func readCachedProbe(path string, info fs.FileInfo) (FFMpegProbe, error) {
+	key := sourceVersionKey(path, info)
+	if probe, ok := probes.Get(key); ok {
+		return probe, nil
+	}
+	probe, err := readProbe(path)
+	if err != nil {
+		return probe, err
+	}
+	probes.Put(key, probe)
+	return probe, nil
+}
+
+func (probe FFMpegProbe) DurationSeconds() (float64, error) {
+	return strconv.ParseFloat(probe.Format.Duration, 64)
 }
 
 func (hdlr RequestHandlers) performSearch(w http.ResponseWriter, r *http.Request) {
@@ -494,36 +458,43 @@ func (hdlr RequestHandlers) performSearch(w http.ResponseWriter, r *http.Request
 		GalleryData:    &GalleryData{},
 	}
 	data.GalleryData.Query = qry
+	sortOptions := availableSortOptions(hdlr.Index.Ready(), true)
+	sorting := readSorting(r.URL.Query(), sortOptions)
+	data.GalleryData.Sorting = sorting
+	data.GalleryData.SortOptions = sortOptions
+	query, err := parseQuery(qry)
+	if err != nil {
+		data.GalleryData.QueryError = err.Error()
+		hdlr.Templates.ExecuteTemplate(w, "baseHTML", data)
+		return
+	}
+	results, err := hdlr.search(url, fp, query)
+	results = hidePosterSidecars(results)
+	sortEntries(results, sorting)
+	filter := readTypeFilter(r.URL.Query())
+	results, data.GalleryData.AvailableTypes, data.GalleryData.AvailableExtensions = filterFiles(results, filter)
+	data.GalleryData.VisibleTypes = filter.Types
+	data.GalleryData.VisibleExtensions = filter.Extensions
 	matchedFiles := []GalleryFileData{}
-	err = filepath.Walk(fp, func(path string, info os.FileInfo, err error) error {
-		if err == nil && strings.Contains(strings.ToLower(info.Name()), strings.ToLower(qry)) {
-			if info.IsDir() {
-				subdir, err := hdlr.ReadDir(path)
-				if err != nil {
-					return nil
-				}
-				data.GalleryData.HasDirectories = true
-				data.GalleryData.Directories = append(data.GalleryData.Directories, GalleryDirectoryData{
-					Name:      info.Name(),
-					Link:      strings.Replace(strings.Replace(path, hdlr.MediaDirectory, "", 1), "/_search", "", 1),
-					FileCount: len(subdir),
-				})
-			} else {
-				matchedFiles = append(matchedFiles, GalleryFileData{
-					Name:      info.Name(),
-					Link:      strings.Replace(strings.Replace(path, hdlr.MediaDirectory, "", 1), "/_search", "", 1),
-					Thumbnail: fmt.Sprintf("/_thumbnail%s", strings.Replace(path, hdlr.MediaDirectory, "", 1)),
-				})
-			}
+	for _, entry := range results {
+		if entry.IsDir {
+			data.GalleryData.HasDirectories = true
+			data.GalleryData.Directories = append(data.GalleryData.Directories, GalleryDirectoryData{
+				Name:      entry.Name,
+				Link:      entry.Path,
+				FileCount: entry.FileCount,
+			})
+			continue
 		}
-		return nil
-	})
+		matchedFiles = append(matchedFiles, newIndexedGalleryFileData(entry))
+	}
 
 	start := (pageNum - 1) * pageLen
 	data.GalleryData.Files = matchedFiles[(pageNum-1)*pageLen : int(math.Min(float64(start+pageLen), float64(len(matchedFiles))))]
 	data.GalleryData.URL = r.URL.Path
 	data.GalleryData.NextPage = pageNum + 1
 	data.GalleryData.HasMore = start+pageLen < len(matchedFiles)
+	hdlr.addVideoDetails(data.GalleryData.Files)
 
 	if err != nil {
 		http.Error(w, "Something just went wrong", http.StatusInternalServerError)
@@ -537,6 +508,33 @@ func (hdlr RequestHandlers) performSearch(w http.ResponseWriter, r *http.Request
 
 }
 
+// walkSearch is how searches go until the library index is ready, files
+// are only described by what the filesystem knows about them
+func (hdlr RequestHandlers) walkSearch(fp string, fn func(entry IndexEntry) error) error {
+	return filepath.Walk(fp, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == fp {
+			return nil
+		}
+		entry := IndexEntry{
+			Path:    mediaPath(filepath.ToSlash(strings.Replace(path, hdlr.MediaDirectory, "", 1))),
+			Name:    info.Name(),
+			Type:    fileType(info.Name()),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+		if info.IsDir() {
+			subdir, err := hdlr.ReadDir(path)
+			if err != nil {
+				return nil
+			}
+			entry.IsDir = true
+			entry.Type = "directory"
+			entry.FileCount = len(subdir)
+		}
+		return fn(entry)
+	})
+}
+
 var streamableVideoExtensions = []string{".mp4", ".webm", ".ogg", ".3gp"}
 
 func isStreamable(filepath string) bool {
@@ -548,11 +546,24 @@ func isStreamable(filepath string) bool {
 	return false
 }
 
+// streamSource is the url and type the content viewer plays a video from
+func streamSource(path string, mimeType string, mode string) (string, string) {
+	switch mode {
+	case playbackDirect:
+		return "/_stream" + path, mimeType
+	case playbackRemux:
+		return "/_stream" + path, "video/mp4"
+	}
+	return "/_hls" + path, "application/x-mpegURL"
+}
+
 func (hdlr RequestHandlers) serveStream(w http.ResponseWriter, r *http.Request) {
-	filepath := r.URL.Path
-	filepath = strings.Replace(filepath, "/_stream", hdlr.MediaDirectory, 1)
-	if !isStreamable(filepath) {
-		http.Error(w, "Not streamable media", http.StatusBadRequest)
+	mediaPath := strings.Replace(r.URL.Path, "/_stream", "", 1)
+	filepath := hdlr.MediaDirectory + mediaPath
+	// picking an audio track other than the first needs a remux, even for
+	// files browsers can play
+	if !isStreamable(filepath) || r.URL.Query().Has("audio") {
+		hdlr.serveConvertedStream(w, r, mediaPath, filepath)
 		return
 	}
 	file, err := os.Open(filepath)
@@ -560,89 +571,70 @@ func (hdlr RequestHandlers) serveStream(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "No file found", http.StatusNotFound)
 		return
 	}
+	defer file.Close()
+	// ServeContent seeks the file for range requests, so only the bytes
+	// asked for are read
+	hdlr.Streams.Serve(w, r, mediaPath, func(w http.ResponseWriter) {
+		hdlr.serveFile(w, r, file)
+	})
+}
 
-	fileContents, err := io.ReadAll(file)
-	st, err := file.Stat()
-	http.ServeContent(w, r, st.Name(), st.ModTime(), bytes.NewReader(fileContents))
-
-	// Come back to transcoding later, it was turning into a nightmare
-	// dt, _ := ffmpeg.Probe(filepath)
-	// var metadata FFMpegProbe
-	// err = json.Unmarshal([]byte(dt), &metadata)
-	// if err != nil {
-	// 	http.Error(w, "Error with metadata", http.StatusInternalServerError)
-	// 	return
-	// }
-
-	// dur, err := strconv.ParseFloat(metadata.Format.Duration, 64)
-	// if err != nil {
-	// 	http.Error(w, "Error with metadata", http.StatusInternalServerError)
-	// 	return
-	// }
-	// br, err := strconv.Atoi(metadata.Format.BitRate)
-	// if err != nil {
-	// 	http.Error(w, "Error with metadata", http.StatusInternalServerError)
-	// 	return
-	// }
-
-	// predictedSize := int(float64(br) * dur)
-	// fmt.Println(predictedSize)
-	// chunkSizeSeconds := 10
-
-	// rangeHeader := r.Header.Get("Range")
-	// rangeHeader = strings.Replace(rangeHeader, "bytes=", "", 1)
-	// fmt.Printf("rnghed: %s\n", rangeHeader)
-	// pts := strings.Split(rangeHeader, "-")
-	// startByte, _ := strconv.Atoi(pts[0])
-	// defer file.Close()
-	// start := float64(0)
-	// if startByte != 0 {
-	// 	// range request
-	// 	// get the time in floatseconds where that byte is
-	// 	start = float64(startByte) / float64(br)
-	// } else {
-	// 	strtStr := r.URL.Query().Get("start")
-	// 	strt, err := strconv.ParseFloat(strtStr, 64)
-	// 	if err == nil {
-	// 		start = strt
-	// 	}
-	// }
-	// st, err := file.Stat()
-
-	// buf := bytes.NewBuffer(nil)
-	// err = ffmpeg.Input(filepath, ffmpeg.KwArgs{"ss": start}).
-	// 	Output("pipe:", ffmpeg.KwArgs{
-	// 		"vcodec":   "libtheora",
-	// 		"acodec":   "libvorbis",
-	// 		"qscale:v": "3",
-	// 		"qscale:a": "3",
-	// 		"b":        metadata.Format.BitRate,
-	// 		"f":        "ogv",
-	// 		"t":        chunkSizeSeconds + 2,
-	// 	}).
-	// 	WithOutput(buf).
-	// 	Run()
-	// if err != nil {
-	// 	http.Error(w, "Something went wrong transcoding", http.StatusInternalServerError)
-	// 	return
-	// }
-	// endByte := startByte + len(buf.Bytes())
-	// w.Header().Set("Content-Type", "video/ogv")
-	// w.Header().Set("Content-Range", fmt.Sprintf(`bytes %d-%d/%d`, startByte, endByte, predictedSize))
-	// w.Header().Set("Accept-Ranges", "bytes")
-	// w.Header().Set("Content-Length", fmt.Sprintf("%d", int64(len(buf.Bytes()))))
-	// w.Header().Set("Last-Modified", st.ModTime().UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT"))
-	// w.WriteHeader(http.StatusPartialContent)
-	// io.CopyN(w, buf, int64(len(buf.Bytes())))
-	return
+// serveConvertedStream remuxes videos that only need a new container, and
+// sends the player to hls for those that need transcoding
+func (hdlr RequestHandlers) serveConvertedStream(w http.ResponseWriter, r *http.Request, mediaPath string, filepath string) {
+	prts := strings.Split(filepath, ".")
+	if !slices.Contains(videoExtensions, strings.ToLower(prts[len(prts)-1])) {
+		http.Error(w, "Not streamable media", http.StatusBadRequest)
+		return
+	}
+	st, err := os.Stat(filepath)
+	if err != nil {
+		http.Error(w, "No file found", http.StatusNotFound)
+		return
+	}
+	probe, err := readCachedProbe(filepath, st)
+	if err != nil {
+		fmt.Println("Error probing video to stream:", err)
+		http.Error(w, "Error reading video", http.StatusInternalServerError)
+		return
+	}
+	audio, ok := audioStream(probe, r.URL.Query())
+	if !ok {
+		http.Error(w, "No such audio track", http.StatusNotFound)
+		return
+	}
+	if !canRemux(probe) {
+		hls := &url.URL{Path: "/_hls" + mediaPath}
+		if audio >= 0 {
+			hls.RawQuery = fmt.Sprintf("audio=%d", audio)
+		}
+		http.Redirect(w, r, hls.String(), http.StatusFound)
+		return
+	}
+	hdlr.Streams.Serve(w, r, mediaPath, func(w http.ResponseWriter) {
+		remuxStream(w, r, filepath, probe, audio)
+	})
 }
 
 func (hdlr RequestHandlers) handlePage(writer http.ResponseWriter, request *http.Request) {
+	if strings.HasPrefix(request.URL.Path, "/_warmup") {
+		// GET for progress, POST to start another run
+		hdlr.handleWarmup(writer, request)
+		return
+	}
 	if request.Method == "GET" {
+		if strings.HasPrefix(request.URL.Path, "/_streams") {
+			hdlr.handleStreams(writer, request)
+			return
+		}
 		if strings.HasPrefix(request.URL.Path, "/_stream") {
 			hdlr.serveStream(writer, request)
 			return
 		}
+		if strings.HasPrefix(request.URL.Path, "/_hls") {
+			hdlr.serveHls(writer, request)
+			return
+		}
 		if strings.HasPrefix(request.URL.Path, "/_media") {
 			hdlr.getMediaFile(writer, request)
 			return
@@ -651,6 +643,30 @@ func (hdlr RequestHandlers) handlePage(writer http.ResponseWriter, request *http
 			hdlr.getThumbnail(writer, request)
 			return
 		}
+		if strings.HasPrefix(request.URL.Path, "/_preview") {
+			hdlr.getPreview(writer, request)
+			return
+		}
+		if strings.HasPrefix(request.URL.Path, "/_sprite") {
+			hdlr.getSpriteSheet(writer, request)
+			return
+		}
+		if strings.HasPrefix(request.URL.Path, "/_storyboard") {
+			hdlr.getStoryboard(writer, request)
+			return
+		}
+		if strings.HasPrefix(request.URL.Path, "/_subtitles") {
+			hdlr.getSubtitles(writer, request)
+			return
+		}
+		if strings.HasPrefix(request.URL.Path, "/_metadata") {
+			hdlr.getMetadata(writer, request)
+			return
+		}
+		if strings.HasPrefix(request.URL.Path, "/_timeline") {
+			hdlr.getTimeline(writer, request)
+			return
+		}
 		if strings.HasPrefix(request.URL.Path, "/_search") {
 			hdlr.performSearch(writer, request)
 			return
@@ -683,11 +699,52 @@ func (hdlr RequestHandlers) handlePage(writer http.ResponseWriter, request *http
 	}
 }
 
+// intSetting reads a numeric environment variable, exiting if it's set
+// to something that isn't a number
+func intSetting(name string, fallback int) int {
+	setting := os.Getenv(name)
+	if setting == "" {
+		return fallback
+	}
+	value, err := strconv.Atoi(setting)
+	if err != nil {
+		fmt.Printf("invalid %s: %s\n", name, err)
+		os.Exit(1)
+	}
+	return value
+}
+
+// thumbnailFormatsSetting reads a comma separated list of thumbnail formats
+func thumbnailFormatsSetting(name string, fallback []string) []string {
+	setting := os.Getenv(name)
+	if setting == "" {
+		return fallback
+	}
+	formats := []string{}
+	for _, part := range strings.Split(setting, ",") {
+		format, ok := thumbnailFormats[strings.ToLower(strings.TrimSpace(part))]
+		if !ok {
+			fmt.Printf("invalid %s: unknown format %q\n", name, part)
+			os.Exit(1)
+		}
+		if !slices.Contains(formats, format) {
+			formats = append(formats, format)
+		}
+	}
+	return formats
+}
+
 func main() {
+	os.Exit(run())
+}
+
+// run serves the gallery until it's stopped, deferred cleanup happens
+// before main exits with what it returns
+func run() int {
 	gotTemplates, err := getTemplates()
 	if err != nil {
 		fmt.Printf("error initialising server: %s\n", err)
-		os.Exit(1)
+		return 1
 	}
 	mediaDir := os.Getenv("SMG_MEDIA_DIRECTORY")
 	if mediaDir == "" {
@@ -698,14 +755,86 @@ func main() {
 	if portSetting != "" {
 		port = portSetting
 	}
+	cacheDir := os.Getenv("SMG_CACHE_DIRECTORY")
+	if cacheDir == "" {
+		cacheDir = "/_cache"
+	}
+	thumbnailCacheMb := intSetting("SMG_THUMBNAIL_CACHE_SIZE_MB", 1024)
+	thumbnailCache, err := NewDiskCache(filepath.Join(cacheDir, "thumbnails"), int64(thumbnailCacheMb)*1024*1024)
+	if err != nil {
+		// we can still serve thumbnails, just slowly
+		fmt.Printf("thumbnail cache disabled: %s\n", err)
+		thumbnailCache = nil
+	}
+	thumbnailWorkers := intSetting("SMG_THUMBNAIL_WORKERS", runtime.NumCPU())
+	imageConcurrency := intSetting("SMG_THUMBNAIL_IMAGE_CONCURRENCY", runtime.NumCPU())
+	videoConcurrency := intSetting("SMG_THUMBNAIL_VIDEO_CONCURRENCY", 2)
+	thumbnailTimeoutSeconds := intSetting("SMG_THUMBNAIL_TIMEOUT_SECONDS", 20)
+	hlsCacheMb := intSetting("SMG_HLS_CACHE_SIZE_MB", 4096)
+	hlsCache, err := NewDiskCache(filepath.Join(cacheDir, "hls"), int64(hlsCacheMb)*1024*1024)
+	if err != nil {
+		fmt.Printf("hls segment cache disabled: %s\n", err)
+		hlsCache = nil
+	}
+	transcoder := NewHlsTranscoder(hlsCache, intSetting("SMG_TRANSCODE_CONCURRENCY", 2))
+	thumbnailer := NewThumbnailer(thumbnailCache, imageConcurrency, videoConcurrency, time.Duration(thumbnailTimeoutSeconds)*time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var thumbnailWarmer *ThumbnailWarmer
+	if thumbnailCache != nil {
+		thumbnailWarmer = &ThumbnailWarmer{
+			MediaDirectory: mediaDir,
+			Thumbnailer:    thumbnailer,
+			Widths:         galleryThumbnailWidths,
+			Formats:        thumbnailFormatsSetting("SMG_THUMBNAIL_WARMUP_FORMATS", warmupThumbnailFormats),
+			Workers:        thumbnailWorkers,
+			Context:        ctx,
+		}
+		if os.Getenv("SMG_THUMBNAIL_WARMUP") != "false" {
+			thumbnailWarmer.Start()
+		}
+	}
+	index, err := OpenLibraryIndex(filepath.Join(cacheDir, "library.db"), mediaDir, thumbnailWorkers)
+	if err != nil {
+		// listings and searches fall back to reading the filesystem
+		fmt.Printf("library index disabled: %s\n", err)
+		index = nil
+	} else {
+		defer func() {
+			// stop any scan before the database closes under it
+			cancel()
+			index.Close()
+		}()
+		index.Start(ctx, time.Duration(intSetting("SMG_INDEX_RESCAN_MINUTES", 60))*time.Minute)
+	}
+	if os.Getenv("SMG_WATCH") != "false" {
+		watcher := &LibraryWatcher{
+			MediaDirectory: mediaDir,
+			Index:          index,
+			Thumbnailer:    thumbnailer,
+			Transcoder:     transcoder,
+			Debounce:       time.Duration(intSetting("SMG_WATCH_DEBOUNCE_SECONDS", 2)) * time.Second,
+			FallbackRescan: time.Duration(intSetting("SMG_WATCH_FALLBACK_RESCAN_MINUTES", 5)) * time.Minute,
+		}
+		err = watcher.Start(ctx)
+		if err != nil {
+			// changes are still picked up by the periodic rescan
+			fmt.Printf("media directory watching disabled: %s\n", err)
+		}
+	}
 	mux := http.NewServeMux()
 
 	hdlr := RequestHandlers{
-		MediaDirectory: mediaDir,
-		Stat:           os.Stat,
-		ReadDir:        os.ReadDir,
-		Templates:      gotTemplates,
-		DetectFile:     mimetype.DetectFile,
+		MediaDirectory:  mediaDir,
+		Stat:            os.Stat,
+		ReadDir:         os.ReadDir,
+		Templates:       gotTemplates,
+		DetectFile:      mimetype.DetectFile,
+		Thumbnailer:     thumbnailer,
+		ThumbnailWarmer: thumbnailWarmer,
+		Transcoder:      transcoder,
+		Streams:         NewStreamTracker(intSetting("SMG_MAX_STREAMS", 4), 2*time.Second),
+		Index:           index,
 	}
 
 	mux.HandleFunc("*", hdlr.handlePage)
@@ -720,15 +849,17 @@ func main() {
 		s := <-osSig
 		// cleanup
 		fmt.Printf("Signal: %v\n", s)
+		cancel()
 		srv.Shutdown(context.TODO())
 	}()
 
 	err = srv.ListenAndServe()
 	if errors.Is(err, http.ErrServerClosed) {
 		fmt.Printf("server closed\n")
-		os.Exit(0)
+		return 0
 	} else if err != nil {
 		fmt.Printf("error starting server: %s\n", err)
-		os.Exit(1)
+		return 1
 	}
+	return 0
 }
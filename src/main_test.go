@@ -81,7 +81,16 @@ func TestMinimumHappyPathDoesntError(t *testing.T) {
 	data := testHandler.getPageData("/", url.Values{}, 1, 25)
 	expGalData := GalleryData{
 		HasDirectories: false,
-		Files:          []GalleryFileData{{"testfilename.jpg", "/testfilename.jpg", "/_thumbnail/testfilename.jpg"}},
+		Files: []GalleryFileData{{
+			Name:      "testfilename.jpg",
+			Link:      "/testfilename.jpg",
+			Thumbnail: "/_thumbnail/testfilename.jpg",
+			Thumbnails: []ThumbnailSize{
+				{320, "/_thumbnail/testfilename.jpg?fit=cover&height=240&width=320"},
+				{640, "/_thumbnail/testfilename.jpg?fit=cover&height=480&width=640"},
+				{960, "/_thumbnail/testfilename.jpg?fit=cover&height=720&width=960"},
+			},
+		}},
 	}
 	expectedData := PageData{
 		ShowBreadcrumb: false,
@@ -108,3 +117,11 @@ func TestMinimumHappyPathDoesntError(t *testing.T) {
 		t.Errorf("Expected %v, but got %v", expGalData.HasDirectories, gd.HasDirectories)
 	}
 }
+
+func TestGalleryFileSrcsetEscapesPaths(t *testing.T) {
+	file := newGalleryFileData("a b.jpg", "/a b.jpg", "/_thumbnail/a b.jpg")
+	expected := "/_thumbnail/a%20b.jpg?fit=cover&height=240&width=320 320w, /_thumbnail/a%20b.jpg?fit=cover&height=480&width=640 640w, /_thumbnail/a%20b.jpg?fit=cover&height=720&width=960 960w"
+	if string(file.Srcset()) != expected {
+		t.Errorf("Expected %s, got %s", expected, file.Srcset())
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"io/fs"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// MediaMetadata is what we can tell about a file beyond its name, shown in
+// the content viewer and served as JSON from /_metadata
+type MediaMetadata struct {
+	Type     string         `json:"type"`
+	Size     int64          `json:"size"`
+	Modified time.Time      `json:"modified"`
+	Width    int            `json:"width,omitempty"`
+	Height   int            `json:"height,omitempty"`
+	Image    *ImageMetadata `json:"image,omitempty"`
+	Video    *VideoMetadata `json:"video,omitempty"`
+}
+
+// ImageMetadata comes from EXIF, with descriptions from XMP or IPTC
+type ImageMetadata struct {
+	Camera      string          `json:"camera,omitempty"`
+	Lens        string          `json:"lens,omitempty"`
+	Exposure    string          `json:"exposure,omitempty"`
+	Aperture    string          `json:"aperture,omitempty"`
+	ISO         int             `json:"iso,omitempty"`
+	FocalLength string          `json:"focalLength,omitempty"`
+	CapturedAt  *time.Time      `json:"capturedAt,omitempty"`
+	GPS         *GPSCoordinates `json:"gps,omitempty"`
+	Title       string          `json:"title,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Keywords    []string        `json:"keywords,omitempty"`
+	Creator     string          `json:"creator,omitempty"`
+	Copyright   string          `json:"copyright,omitempty"`
+}
+
+type GPSCoordinates struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// VideoMetadata is a summary of ffprobe's output, which is included in
+// full as Probe
+type VideoMetadata struct {
+	Container  string          `json:"container,omitempty"`
+	Duration   float64         `json:"duration,omitempty"`
+	Bitrate    int             `json:"bitrate,omitempty"`
+	VideoCodec string          `json:"videoCodec,omitempty"`
+	FrameRate  float64         `json:"frameRate,omitempty"`
+	Audio      []AudioMetadata `json:"audio,omitempty"`
+	Probe      json.RawMessage `json:"probe,omitempty"`
+}
+
+type AudioMetadata struct {
+	Codec         string `json:"codec"`
+	Channels      int    `json:"channels,omitempty"`
+	ChannelLayout string `json:"channelLayout,omitempty"`
+	SampleRate    int    `json:"sampleRate,omitempty"`
+	Language      string `json:"language,omitempty"`
+}
+
+// MetadataField is a line in the content viewer's details panel
+type MetadataField struct {
+	Label, Value string
+}
+
+func readMediaMetadata(path string, info fs.FileInfo, mimeType string) *MediaMetadata {
+	metadata := &MediaMetadata{Type: mimeType, Size: info.Size(), Modified: info.ModTime()}
+	if strings.HasPrefix(mimeType, "image") {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return metadata
+		}
+		if config, _, err := image.DecodeConfig(bytes.NewReader(contents)); err == nil {
+			metadata.Width, metadata.Height = config.Width, config.Height
+		}
+		metadata.Image = readImageMetadata(contents)
+	}
+	if strings.HasPrefix(mimeType, "video") {
+		probe, err := readCachedProbe(path, info)
+		if err != nil {
+			return metadata
+		}
+		return probedMediaMetadata(info, mimeType, probe)
+	}
+	return metadata
+}
+
+// probedMediaMetadata is readMediaMetadata for a video that's already
+// been probed
+func probedMediaMetadata(info fs.FileInfo, mimeType string, probe FFMpegProbe) *MediaMetadata {
+	metadata := &MediaMetadata{Type: mimeType, Size: info.Size(), Modified: info.ModTime()}
+	metadata.Video = readVideoMetadata(probe)
+	for _, stream := range probe.Streams {
+		if stream.CodecType == "video" {
+			metadata.Width, metadata.Height = stream.Width, stream.Height
+			break
+		}
+	}
+	return metadata
+}
+
+func readImageMetadata(contents []byte) *ImageMetadata {
+	metadata := &ImageMetadata{}
+	if x, err := readExif(contents); err == nil && x != nil {
+		cameraMake, model := exifString(x, exif.Make), exifString(x, exif.Model)
+		if strings.HasPrefix(model, cameraMake) {
+			// plenty of cameras put the make in the model too
+			cameraMake = ""
+		}
+		metadata.Camera = strings.TrimSpace(cameraMake + " " + model)
+		metadata.Lens = exifString(x, exif.LensModel)
+		if exposure, ok := exifFloat(x, exif.ExposureTime); ok && exposure > 0 {
+			if exposure < 1 {
+				metadata.Exposure = fmt.Sprintf("1/%ds", int(math.Round(1/exposure)))
+			} else {
+				metadata.Exposure = fmt.Sprintf("%gs", exposure)
+			}
+		}
+		if aperture, ok := exifFloat(x, exif.FNumber); ok {
+			metadata.Aperture = "f/" + strconv.FormatFloat(aperture, 'f', -1, 64)
+		}
+		if tag, err := x.Get(exif.ISOSpeedRatings); err == nil {
+			metadata.ISO, _ = tag.Int(0)
+		}
+		if focal, ok := exifFloat(x, exif.FocalLength); ok {
+			metadata.FocalLength = strconv.FormatFloat(focal, 'f', -1, 64) + "mm"
+		}
+		if captured, err := x.DateTime(); err == nil {
+			metadata.CapturedAt = &captured
+		}
+		if lat, long, err := x.LatLong(); err == nil && !math.IsNaN(lat) && !math.IsNaN(long) {
+			metadata.GPS = &GPSCoordinates{Latitude: lat, Longitude: long}
+		}
+	}
+
+	xmp := readXmp(contents)
+	iptc := readIptc(contents)
+	first := func(values ...[]string) []string {
+		for _, value := range values {
+			if len(value) > 0 {
+				return value
+			}
+		}
+		return nil
+	}
+	metadata.Title = strings.Join(first(xmp["title"], iptc[5]), " ")
+	metadata.Description = strings.Join(first(xmp["description"], iptc[120]), " ")
+	metadata.Keywords = first(xmp["subject"], iptc[25])
+	metadata.Creator = strings.Join(first(xmp["creator"], iptc[80]), ", ")
+	metadata.Copyright = strings.Join(first(xmp["rights"], iptc[116]), " ")
+	return metadata
+}
+
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	value, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.Trim(value, "\x00"))
+}
+
+func exifFloat(x *exif.Exif, name exif.FieldName) (float64, bool) {
+	tag, err := x.Get(name)
+	if err != nil {
+		return 0, false
+	}
+	rat, err := tag.Rat(0)
+	if err != nil {
+		return 0, false
+	}
+	value, _ := rat.Float64()
+	return value, true
+}
+
+const dublinCore = "http://purl.org/dc/elements/1.1/"
+
+// readXmp pulls the Dublin Core fields out of an XMP packet, which can be
+// embedded in most image formats
+func readXmp(contents []byte) map[string][]string {
+	values := map[string][]string{}
+	start := bytes.Index(contents, []byte("<x:xmpmeta"))
+	if start < 0 {
+		return values
+	}
+	end := bytes.Index(contents[start:], []byte("</x:xmpmeta>"))
+	if end < 0 {
+		return values
+	}
+	decoder := xml.NewDecoder(bytes.NewReader(contents[start : start+end+len("</x:xmpmeta>")]))
+	current := ""
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return values
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if t.Name.Space == dublinCore {
+				current = t.Name.Local
+			}
+		case xml.EndElement:
+			if t.Name.Space == dublinCore {
+				current = ""
+			}
+		case xml.CharData:
+			if text := strings.TrimSpace(string(t)); current != "" && text != "" {
+				values[current] = append(values[current], text)
+			}
+		}
+	}
+}
+
+// readIptc reads the IPTC-IIM application record from the Photoshop block
+// jpegs keep it in, keyed by dataset number (5 title, 25 keywords, 80
+// by-line, 116 copyright, 120 caption)
+func readIptc(contents []byte) map[int][]string {
+	values := map[int][]string{}
+	offset := bytes.Index(contents, []byte("8BIM\x04\x04"))
+	if offset < 0 || offset+7 > len(contents) {
+		return values
+	}
+	// a padded pascal string name, then the size of the resource
+	pos := offset + 6
+	nameLength := int(contents[pos]) + 1
+	pos += nameLength + nameLength%2
+	if pos+4 > len(contents) {
+		return values
+	}
+	size := int(binary.BigEndian.Uint32(contents[pos:]))
+	pos += 4
+	if size < 0 || pos+size > len(contents) {
+		return values
+	}
+	data := contents[pos : pos+size]
+	for i := 0; i+5 <= len(data); {
+		if data[i] != 0x1c {
+			i++
+			continue
+		}
+		record, dataset := data[i+1], int(data[i+2])
+		length := int(binary.BigEndian.Uint16(data[i+3:]))
+		if length&0x8000 != 0 || i+5+length > len(data) {
+			break
+		}
+		if record == 2 {
+			values[dataset] = append(values[dataset], strings.TrimSpace(string(data[i+5:i+5+length])))
+		}
+		i += 5 + length
+	}
+	return values
+}
+
+func readVideoMetadata(probe FFMpegProbe) *VideoMetadata {
+	metadata := &VideoMetadata{Container: probe.Format.FormatLongName, Probe: probe.Raw}
+	metadata.Duration, _ = probe.DurationSeconds()
+	metadata.Bitrate, _ = strconv.Atoi(probe.Format.BitRate)
+	for _, stream := range probe.Streams {
+		switch stream.CodecType {
+		case "video":
+			if metadata.VideoCodec == "" {
+				metadata.VideoCodec = stream.CodecName
+				metadata.FrameRate = parseFrameRate(stream.AverageFrameRate)
+			}
+		case "audio":
+			sampleRate, _ := strconv.Atoi(stream.SampleRate)
+			metadata.Audio = append(metadata.Audio, AudioMetadata{
+				Codec:         stream.CodecName,
+				Channels:      stream.Channels,
+				ChannelLayout: stream.ChannelLayout,
+				SampleRate:    sampleRate,
+				Language:      stream.Tags.Language,
+			})
+		}
+	}
+	return metadata
+}
+
+// parseFrameRate reads ffprobe's fractions, like 24000/1001
+func parseFrameRate(rate string) float64 {
+	numerator, denominator, found := strings.Cut(rate, "/")
+	n, err := strconv.ParseFloat(numerator, 64)
+	if err != nil {
+		return 0
+	}
+	if !found {
+		return n
+	}
+	d, err := strconv.ParseFloat(denominator, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+func formatBytes(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// Fields lists whatever we know, in the order the details panel shows it
+func (metadata *MediaMetadata) Fields() []MetadataField {
+	fields := []MetadataField{}
+	add := func(label string, value string) {
+		if value != "" {
+			fields = append(fields, MetadataField{label, value})
+		}
+	}
+	add("Size", formatBytes(metadata.Size))
+	add("Modified", metadata.Modified.Format("2 Jan 2006 15:04"))
+	if metadata.Width > 0 && metadata.Height > 0 {
+		add("Dimensions", fmt.Sprintf("%d × %d", metadata.Width, metadata.Height))
+	}
+	if photo := metadata.Image; photo != nil {
+		add("Title", photo.Title)
+		add("Description", photo.Description)
+		add("Keywords", strings.Join(photo.Keywords, ", "))
+		add("Creator", photo.Creator)
+		add("Copyright", photo.Copyright)
+		if photo.CapturedAt != nil {
+			add("Taken", photo.CapturedAt.Format("2 Jan 2006 15:04"))
+		}
+		add("Camera", photo.Camera)
+		add("Lens", photo.Lens)
+		add("Exposure", photo.Exposure)
+		add("Aperture", photo.Aperture)
+		if photo.ISO > 0 {
+			add("ISO", strconv.Itoa(photo.ISO))
+		}
+		add("Focal length", photo.FocalLength)
+		if photo.GPS != nil {
+			add("Location", fmt.Sprintf("%.5f, %.5f", photo.GPS.Latitude, photo.GPS.Longitude))
+		}
+	}
+	if video := metadata.Video; video != nil {
+		add("Container", video.Container)
+		add("Video codec", video.VideoCodec)
+		if video.FrameRate > 0 {
+			add("Frame rate", strconv.FormatFloat(math.Round(video.FrameRate*100)/100, 'f', -1, 64)+" fps")
+		}
+		if video.Bitrate > 0 {
+			add("Bitrate", fmt.Sprintf("%d kb/s", video.Bitrate/1000))
+		}
+		for i, audio := range video.Audio {
+			description := []string{audio.Codec}
+			if audio.ChannelLayout != "" {
+				description = append(description, audio.ChannelLayout)
+			} else if audio.Channels > 0 {
+				description = append(description, fmt.Sprintf("%d channels", audio.Channels))
+			}
+			if audio.SampleRate > 0 {
+				description = append(description, fmt.Sprintf("%d Hz", audio.SampleRate))
+			}
+			if audio.Language != "" {
+				description = append(description, audio.Language)
+			}
+			add(fmt.Sprintf("Audio %d", i+1), strings.Join(description, ", "))
+		}
+	}
+	return fields
+}
+
+func (hdlr RequestHandlers) getMetadata(w http.ResponseWriter, r *http.Request) {
+	filepath := strings.Replace(r.URL.Path, "/_metadata", hdlr.MediaDirectory, 1)
+	st, err := os.Stat(filepath)
+	if err != nil || st.IsDir() {
+		http.Error(w, "No file found", http.StatusNotFound)
+		return
+	}
+	mtype, err := hdlr.DetectFile(filepath)
+	if err != nil {
+		http.Error(w, "Error reading file", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(readMediaMetadata(filepath, st, mtype.String()))
+}
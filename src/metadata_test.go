@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+func TestReadXmp(t *testing.T) {
+	packet := `junk<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description xmlns:dc="http://purl.org/dc/elements/1.1/">
+<dc:title><rdf:Alt><rdf:li xml:lang="x-default">Harbour at dusk</rdf:li></rdf:Alt></dc:title>
+<dc:subject><rdf:Bag><rdf:li>boats</rdf:li><rdf:li>sea</rdf:li></rdf:Bag></dc:subject>
+</rdf:Description></rdf:RDF></x:xmpmeta>junk`
+	xmp := readXmp([]byte(packet))
+	if strings.Join(xmp["title"], "|") != "Harbour at dusk" || strings.Join(xmp["subject"], "|") != "boats|sea" {
+		t.Errorf("Expected title and keywords, but got %v", xmp)
+	}
+}
+
+func TestReadIptc(t *testing.T) {
+	record := func(dataset byte, value string) []byte {
+		return append([]byte{0x1c, 2, dataset, 0, byte(len(value))}, value...)
+	}
+	data := bytes.Join([][]byte{record(5, "Title"), record(25, "one"), record(25, "two")}, nil)
+	block := append([]byte("Photoshop 3.0\x008BIM\x04\x04\x00\x00"), 0, 0, 0, byte(len(data)))
+	iptc := readIptc(append(block, data...))
+	if strings.Join(iptc[5], "|") != "Title" || strings.Join(iptc[25], "|") != "one|two" {
+		t.Errorf("Expected title and keywords, but got %v", iptc)
+	}
+	// truncated blocks don't panic
+	readIptc(block)
+}
+
+func TestVideoMetadataFields(t *testing.T) {
+	probe := FFMpegProbe{
+		Format: FFMPegProbeFormat{Duration: "61.5", BitRate: "4500000", FormatLongName: "Matroska / WebM"},
+		Streams: []FFMPegStreamFormat{
+			{CodecType: "video", CodecName: "h264", AverageFrameRate: "24000/1001", Width: 1920, Height: 1080},
+			{CodecType: "audio", CodecName: "ac3", ChannelLayout: "5.1(side)", SampleRate: "48000", Tags: FFMPegStreamTags{Language: "eng"}},
+		},
+	}
+	metadata := &MediaMetadata{Size: 3 * 1024 * 1024, Width: 1920, Height: 1080, Video: readVideoMetadata(probe)}
+	fields := map[string]string{}
+	for _, field := range metadata.Fields() {
+		fields[field.Label] = field.Value
+	}
+	expected := map[string]string{
+		"Size":       "3.0 MB",
+		"Dimensions": "1920 × 1080",
+		"Container":  "Matroska / WebM",
+		"Frame rate": "23.98 fps",
+		"Bitrate":    "4500 kb/s",
+		"Audio 1":    "ac3, 5.1(side), 48000 Hz, eng",
+	}
+	for label, value := range expected {
+		if fields[label] != value {
+			t.Errorf("Expected %s to be %q, but got %q", label, value, fields[label])
+		}
+	}
+}
+
+func TestGetMetadata(t *testing.T) {
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "a.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	png.Encode(f, image.NewRGBA(image.Rect(0, 0, 30, 20)))
+	f.Close()
+	hdlr := RequestHandlers{MediaDirectory: dir, DetectFile: mimetype.DetectFile}
+
+	rec := httptest.NewRecorder()
+	hdlr.getMetadata(rec, httptest.NewRequest("GET", "/_metadata/a.png", nil))
+	var metadata MediaMetadata
+	if err := json.Unmarshal(rec.Body.Bytes(), &metadata); err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Type != "image/png" || metadata.Width != 30 || metadata.Height != 20 || metadata.Image == nil {
+		t.Errorf("Expected a 30x20 png, but got %+v", metadata)
+	}
+}
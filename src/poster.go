@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io/fs"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"strings"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+var (
+	// POSTER_CANDIDATES are the points through a video, as fractions of
+	// its length, that are considered for its poster
+	POSTER_CANDIDATES = []float64{0.1, 0.25, 0.4, 0.5, 0.6, 0.75}
+	// frames darker than POSTER_MIN_BRIGHTNESS or flatter than
+	// POSTER_MIN_ENTROPY are fades, title cards and the like
+	POSTER_MIN_BRIGHTNESS = 0.08
+	POSTER_MIN_ENTROPY    = 3.0
+)
+
+// frameVariant names the chosen video frame in the thumbnail cache
+const frameVariant = "frame-v2"
+
+// posterSidecarSuffixes are looked for next to a video, so movie.mp4 can
+// have its poster in movie-poster.jpg or movie.jpg
+var posterSidecarSuffixes = []string{"-poster", ""}
+
+var posterSidecarExtensions = []string{"jpg", "jpeg", "png", "webp"}
+
+// posterDirectories remembers the names in directories with videos in, by
+// their mtime, so finding a tile's poster doesn't stat a dozen names
+var posterDirectories = newMemoryCache[map[string]bool](64)
+
+// posterSidecar finds an image next to the video to use as its poster
+func posterSidecar(videoPath string) (string, fs.FileInfo) {
+	dir := filepath.Dir(videoPath)
+	dirInfo, err := os.Stat(dir)
+	if err != nil {
+		return "", nil
+	}
+	key := fmt.Sprintf("%s-%d", dir, dirInfo.ModTime().UnixNano())
+	names, ok := posterDirectories.Get(key)
+	if !ok {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return "", nil
+		}
+		names = map[string]bool{}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				names[entry.Name()] = true
+			}
+		}
+		posterDirectories.Put(key, names)
+	}
+	name := posterSidecarName(filepath.Base(videoPath), names)
+	if name == "" {
+		return "", nil
+	}
+	poster := filepath.Join(dir, name)
+	info, err := os.Stat(poster)
+	if err != nil {
+		return "", nil
+	}
+	return poster, info
+}
+
+// posterSidecarName picks a video's poster out of the files next to it
+func posterSidecarName(videoName string, names map[string]bool) string {
+	base := strings.TrimSuffix(videoName, filepath.Ext(videoName))
+	for _, suffix := range posterSidecarSuffixes {
+		for _, ext := range posterSidecarExtensions {
+			for _, candidate := range []string{base + suffix + "." + ext, base + suffix + "." + strings.ToUpper(ext)} {
+				if names[candidate] {
+					return candidate
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// hidePosterSidecars drops images that are a video's poster, they're shown
+// as the video's thumbnail rather than a tile of their own
+func hidePosterSidecars(entries []IndexEntry) []IndexEntry {
+	names := map[string]map[string]bool{}
+	for _, entry := range entries {
+		if entry.IsDir {
+			continue
+		}
+		dir := parentPath(entry.Path)
+		if names[dir] == nil {
+			names[dir] = map[string]bool{}
+		}
+		names[dir][entry.Name] = true
+	}
+	posters := map[string]bool{}
+	for _, entry := range entries {
+		if entry.Type != "video" {
+			continue
+		}
+		if name := posterSidecarName(entry.Name, names[parentPath(entry.Path)]); name != "" {
+			posters[pathpkg.Join(parentPath(entry.Path), name)] = true
+		}
+	}
+	if len(posters) == 0 {
+		return entries
+	}
+	shown := []IndexEntry{}
+	for _, entry := range entries {
+		if !posters[entry.Path] {
+			shown = append(shown, entry)
+		}
+	}
+	return shown
+}
+
+func readFrameAt(inFileName string, seconds float64) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	// seeking on the input jumps straight there rather than decoding
+	// everything before it
+	err := ffmpeg.Input(inFileName, ffmpeg.KwArgs{"ss": seconds}).
+		Output("pipe:", ffmpeg.KwArgs{"vframes": 1, "format": "image2", "vcodec": "mjpeg"}).
+		WithOutput(buf).
+		Run()
+	if err != nil {
+		return nil, err
+	}
+	if buf.Len() == 0 {
+		return nil, fmt.Errorf("no frame at %fs", seconds)
+	}
+	return buf.Bytes(), nil
+}
+
+func meanLuminance(img image.Image) float64 {
+	bounds := img.Bounds()
+	step := sampleStep(bounds)
+	total, count := 0.0, 0.0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x < bounds.Max.X; x += step {
+			total += luminance(img, x, y)
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	return total / count
+}
+
+// isInterestingFrame rules out near black and near featureless frames
+func isInterestingFrame(img image.Image) (bool, float64) {
+	entropy := entropyScore(img, img.Bounds())
+	return meanLuminance(img) >= POSTER_MIN_BRIGHTNESS && entropy >= POSTER_MIN_ENTROPY, entropy
+}
+
+// ReadPreviewFrameAsJpeg picks a poster frame for a video. A handful of
+// points through the video are tried, skipping dark or flat frames, and
+// the most detailed of the rest wins.
+func ReadPreviewFrameAsJpeg(inFileName string) ([]byte, error) {
+	probe, err := readProbe(inFileName)
+	if err != nil {
+		return nil, err
+	}
+	duration, err := probe.DurationSeconds()
+	if err != nil || duration <= 0 {
+		// no idea how long it is, so the first frame will have to do
+		return readFrameAt(inFileName, 0)
+	}
+
+	var best, fallback []byte
+	bestEntropy, fallbackEntropy := -1.0, -1.0
+	for _, candidate := range POSTER_CANDIDATES {
+		byts, err := readFrameAt(inFileName, duration*candidate)
+		if err != nil {
+			continue
+		}
+		img, err := jpeg.Decode(bytes.NewReader(byts))
+		if err != nil {
+			continue
+		}
+		interesting, entropy := isInterestingFrame(img)
+		if interesting && entropy > bestEntropy {
+			best, bestEntropy = byts, entropy
+		}
+		if entropy > fallbackEntropy {
+			fallback, fallbackEntropy = byts, entropy
+		}
+	}
+	if best != nil {
+		return best, nil
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	return readFrameAt(inFileName, 0)
+}
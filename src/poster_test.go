@@ -0,0 +1,62 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPosterSidecarPrefersPosterSuffix(t *testing.T) {
+	dir := t.TempDir()
+	video := filepath.Join(dir, "movie.mp4")
+	for _, name := range []string{"movie.mp4", "movie.jpg", "movie-poster.png"} {
+		os.WriteFile(filepath.Join(dir, name), []byte{}, 0644)
+	}
+
+	poster, info := posterSidecar(video)
+	if poster != filepath.Join(dir, "movie-poster.png") || info == nil {
+		t.Errorf("Expected movie-poster.png, got %s", poster)
+	}
+
+	os.Remove(filepath.Join(dir, "movie-poster.png"))
+	poster, _ = posterSidecar(video)
+	if poster != filepath.Join(dir, "movie.jpg") {
+		t.Errorf("Expected movie.jpg, got %s", poster)
+	}
+}
+
+func TestHidePosterSidecars(t *testing.T) {
+	entries := []IndexEntry{
+		{Path: "/movie.mp4", Name: "movie.mp4", Type: "video"},
+		{Path: "/movie.jpg", Name: "movie.jpg", Type: "image"},
+		{Path: "/movie-poster.png", Name: "movie-poster.png", Type: "image"},
+		{Path: "/other/movie.jpg", Name: "movie.jpg", Type: "image"},
+	}
+	shown := hidePosterSidecars(entries)
+	names := []string{}
+	for _, entry := range shown {
+		names = append(names, entry.Path)
+	}
+	if len(shown) != 3 || shown[1].Path != "/movie.jpg" {
+		t.Errorf("Expected only movie-poster.png to be hidden, but got %v", names)
+	}
+}
+
+func TestIsInterestingFrameSkipsBlackFrames(t *testing.T) {
+	black := image.NewRGBA(image.Rect(0, 0, 64, 36))
+	if interesting, _ := isInterestingFrame(black); interesting {
+		t.Errorf("Expected a black frame to be skipped")
+	}
+
+	noisy := image.NewRGBA(image.Rect(0, 0, 64, 36))
+	for y := 0; y < 36; y++ {
+		for x := 0; x < 64; x++ {
+			noisy.Set(x, y, color.Gray{uint8((x*37 + y*91) % 256)})
+		}
+	}
+	if interesting, _ := isInterestingFrame(noisy); !interesting {
+		t.Errorf("Expected a detailed frame to be used")
+	}
+}
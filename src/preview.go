@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+var (
+	// PREVIEW_CLIPS clips of PREVIEW_CLIP_SECONDS are taken from evenly
+	// across a video
+	PREVIEW_CLIPS        = 4
+	PREVIEW_CLIP_SECONDS = 1.5
+	PREVIEW_WIDTH        = 320
+	// PREVIEW_MAX_SECONDS stops a long gif becoming a long preview
+	PREVIEW_MAX_SECONDS = 6.0
+)
+
+// previewVariant names previews in the thumbnail cache
+const previewVariant = "preview-v1"
+
+// hasAnimatedPreview is whether the gallery should offer a preview on
+// hover for a file with this extension
+func hasAnimatedPreview(ext string) bool {
+	return slices.Contains(videoExtensions, ext) || ext == "gif"
+}
+
+// ReadAnimatedPreview makes a short, small, muted mp4 that loops nicely
+// in the gallery. Videos get a few clips from across their length, gifs
+// are simply converted.
+func ReadAnimatedPreview(inFileName string, isVideo bool) ([]byte, error) {
+	out, err := os.CreateTemp("", "smg-preview-*.mp4")
+	if err != nil {
+		return nil, err
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	var stream *ffmpeg.Stream
+	if isVideo {
+		probe, err := readProbe(inFileName)
+		if err != nil {
+			return nil, err
+		}
+		duration, err := probe.DurationSeconds()
+		if err != nil {
+			return nil, err
+		}
+		clips := []*ffmpeg.Stream{}
+		for i := 1; i <= PREVIEW_CLIPS; i++ {
+			start := duration * float64(i) / float64(PREVIEW_CLIPS+1)
+			clips = append(clips, ffmpeg.Input(inFileName, ffmpeg.KwArgs{"ss": start, "t": PREVIEW_CLIP_SECONDS}).Video())
+		}
+		stream = ffmpeg.Concat(clips, ffmpeg.KwArgs{"v": 1, "a": 0})
+	} else {
+		stream = ffmpeg.Input(inFileName, ffmpeg.KwArgs{"t": PREVIEW_MAX_SECONDS}).Video()
+	}
+	err = stream.
+		// h264 needs even dimensions
+		Filter("scale", ffmpeg.Args{fmt.Sprintf("trunc(min(%d,iw)/2)*2:-2", PREVIEW_WIDTH)}).
+		Output(out.Name(), ffmpeg.KwArgs{
+			"an":       "",
+			"c:v":      "libx264",
+			"preset":   "veryfast",
+			"crf":      30,
+			"pix_fmt":  "yuv420p",
+			"movflags": "+faststart",
+			"r":        15,
+			"f":        "mp4",
+		}).
+		OverWriteOutput().
+		Run()
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(out.Name())
+}
+
+// LoadPreview returns the animated preview from the cache, generating it
+// if need be. It shares the ffmpeg budget with video thumbnails.
+func (t *Thumbnailer) LoadPreview(ctx context.Context, req thumbnailRequest) ([]byte, error) {
+	return t.inFlight.loadDerived(ctx, t.Cache, t.videos, req.path, req.info, previewVariant, func() ([]byte, error) {
+		return ReadAnimatedPreview(req.path, req.isVideo)
+	})
+}
+
+func (hdlr RequestHandlers) getPreview(w http.ResponseWriter, r *http.Request) {
+	filepath := strings.Replace(r.URL.Path, "/_preview", hdlr.MediaDirectory, 1)
+	st, err := os.Stat(filepath)
+	if err != nil {
+		http.Error(w, "No file found", http.StatusNotFound)
+		return
+	}
+	prts := strings.Split(filepath, ".")
+	ext := strings.ToLower(prts[len(prts)-1])
+	if !hasAnimatedPreview(ext) {
+		http.Error(w, "No preview for this file", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := hdlr.Thumbnailer.requestContext(r)
+	defer cancel()
+	byts, err := hdlr.Thumbnailer.LoadPreview(ctx, thumbnailRequest{
+		path:    filepath,
+		info:    st,
+		isVideo: slices.Contains(videoExtensions, ext),
+	})
+	if err != nil {
+		fmt.Println("Error generating preview:", err)
+		// the gallery keeps showing the still thumbnail
+		w.Header().Set("Cache-Control", "no-store")
+		http.Error(w, "Preview unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp4")
+	http.ServeContent(w, r, st.Name(), st.ModTime(), bytes.NewReader(byts))
+}
@@ -0,0 +1,585 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// A search query is a list of terms, all of which have to match:
+//
+//	beach "sunset walk" type:video duration>5m -ext:mov in:/holidays
+//
+// Bare words are looked for in names, captions and folder names, allowing
+// for typos, and quoted phrases have to appear exactly in a name or
+// caption. Terms can be negated with a leading - or NOT, combined with OR
+// and grouped with brackets. Fields are compared with :, =, >, >=, < or <=.
+
+// QueryError is what's wrong with a query, and where
+type QueryError struct {
+	Position int
+	Message  string
+}
+
+func (err *QueryError) Error() string {
+	return fmt.Sprintf("%s (at character %d)", err.Message, err.Position+1)
+}
+
+func queryErrorf(position int, format string, args ...any) *QueryError {
+	return &QueryError{Position: position, Message: fmt.Sprintf(format, args...)}
+}
+
+// queryNode is a parsed query, or part of one
+type queryNode interface {
+	match(entry IndexEntry) bool
+	String() string
+}
+
+type andQuery []queryNode
+
+func (q andQuery) match(entry IndexEntry) bool {
+	for _, node := range q {
+		if !node.match(entry) {
+			return false
+		}
+	}
+	return true
+}
+
+func (q andQuery) String() string {
+	parts := []string{}
+	for _, node := range q {
+		parts = append(parts, node.String())
+	}
+	return "(and " + strings.Join(parts, " ") + ")"
+}
+
+type orQuery []queryNode
+
+func (q orQuery) match(entry IndexEntry) bool {
+	for _, node := range q {
+		if node.match(entry) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q orQuery) String() string {
+	parts := []string{}
+	for _, node := range q {
+		parts = append(parts, node.String())
+	}
+	return "(or " + strings.Join(parts, " ") + ")"
+}
+
+type notQuery struct {
+	query queryNode
+}
+
+func (q notQuery) match(entry IndexEntry) bool {
+	return !q.query.match(entry)
+}
+
+func (q notQuery) String() string {
+	return "(not " + q.query.String() + ")"
+}
+
+// textQuery is a bare word, which is matched against the words in names,
+// captions and folders allowing for typos, or a quoted phrase, which has to
+// appear as it is in the name or a caption
+type textQuery struct {
+	text   string
+	phrase bool
+}
+
+func (q textQuery) match(entry IndexEntry) bool {
+	if !q.phrase {
+		return wordScore(entryTerms(entry), q.text) > 0
+	}
+	if strings.Contains(strings.ToLower(entry.Name), q.text) {
+		return true
+	}
+	for _, caption := range captions(entry) {
+		if strings.Contains(strings.ToLower(caption), q.text) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q textQuery) String() string {
+	return strconv.Quote(q.text)
+}
+
+// fieldQuery is a field compared with a value, like size>10MB
+type fieldQuery struct {
+	field string
+	op    string
+	value string
+	// number is the value of size, duration, width and height terms
+	number float64
+	// from and to are the period a taken term covers, to is exclusive
+	from, to time.Time
+}
+
+func (q fieldQuery) String() string {
+	return q.field + q.op + strconv.Quote(q.value)
+}
+
+func (q fieldQuery) match(entry IndexEntry) bool {
+	switch q.field {
+	case "type":
+		return entry.Type == q.value
+	case "in":
+		return q.value == "/" || strings.HasPrefix(entry.Path, q.value+"/")
+	}
+	if entry.IsDir {
+		// folders don't have sizes, cameras or anything else
+		return false
+	}
+	switch q.field {
+	case "ext":
+		return strings.EqualFold(strings.TrimPrefix(pathExt(entry.Name), "."), q.value)
+	case "size":
+		return compareNumbers(float64(entry.Size), q.op, q.number)
+	case "duration":
+		return entry.Duration > 0 && compareNumbers(math.Floor(entry.Duration), q.op, q.number)
+	case "width":
+		return entry.Width > 0 && compareNumbers(float64(entry.Width), q.op, q.number)
+	case "height":
+		return entry.Height > 0 && compareNumbers(float64(entry.Height), q.op, q.number)
+	case "camera":
+		photo := entryImageMetadata(entry)
+		return photo != nil && strings.Contains(strings.ToLower(photo.Camera), q.value)
+	case "taken":
+		taken := entryTaken(entry)
+		switch q.op {
+		case ">":
+			return !taken.Before(q.to)
+		case ">=":
+			return !taken.Before(q.from)
+		case "<":
+			return taken.Before(q.from)
+		case "<=":
+			return taken.Before(q.to)
+		}
+		return !taken.Before(q.from) && taken.Before(q.to)
+	}
+	return false
+}
+
+func pathExt(name string) string {
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return ""
+	}
+	return name[i:]
+}
+
+func entryImageMetadata(entry IndexEntry) *ImageMetadata {
+	if entry.Metadata == nil {
+		return nil
+	}
+	return entry.Metadata.Image
+}
+
+// entryTaken is when a photo was taken, or for anything that doesn't say,
+// when it was last modified
+func entryTaken(entry IndexEntry) time.Time {
+	if photo := entryImageMetadata(entry); photo != nil && photo.CapturedAt != nil {
+		return *photo.CapturedAt
+	}
+	return entry.ModTime
+}
+
+func compareNumbers(value float64, op string, target float64) bool {
+	switch op {
+	case ">":
+		return value > target
+	case ">=":
+		return value >= target
+	case "<":
+		return value < target
+	case "<=":
+		return value <= target
+	}
+	return value == target
+}
+
+// queryFields are the fields a term can name, and an example of each
+var queryFields = map[string]string{
+	"type":     "type:video",
+	"ext":      "ext:png",
+	"size":     "size>10MB",
+	"taken":    "taken:2023-06",
+	"duration": "duration>5m",
+	"width":    "width>=4000",
+	"height":   "height>=3000",
+	"camera":   `camera:"Pixel 7"`,
+	"in":       "in:/holidays",
+}
+
+func queryFieldNames() string {
+	names := []string{}
+	for name := range queryFields {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
+
+type queryTokenKind int
+
+const (
+	tokenWord queryTokenKind = iota
+	tokenPhrase
+	tokenField
+	tokenNot
+	tokenOr
+	tokenOpen
+	tokenClose
+)
+
+type queryToken struct {
+	kind     queryTokenKind
+	position int
+	text     string
+	// op and value are set on field tokens, text is then the field
+	op    string
+	value string
+}
+
+var fieldPattern = regexp.MustCompile(`^([a-zA-Z]+)(>=|<=|:|=|>|<)`)
+
+func tokenizeQuery(query string) ([]queryToken, error) {
+	tokens := []queryToken{}
+	runes := []rune(query)
+	i := 0
+	// readQuoted reads a quoted string starting at runes[i]
+	readQuoted := func() (string, error) {
+		start := i
+		i++
+		for i < len(runes) && runes[i] != '"' {
+			i++
+		}
+		if i >= len(runes) {
+			return "", queryErrorf(start, "this quote is never closed")
+		}
+		i++
+		return string(runes[start+1 : i-1]), nil
+	}
+	// readWord reads up to the next space or bracket
+	readWord := func() string {
+		start := i
+		for i < len(runes) && !unicode.IsSpace(runes[i]) && runes[i] != '(' && runes[i] != ')' {
+			i++
+		}
+		return string(runes[start:i])
+	}
+	for i < len(runes) {
+		r := runes[i]
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, queryToken{kind: tokenOpen, position: start})
+			i++
+		case r == ')':
+			tokens = append(tokens, queryToken{kind: tokenClose, position: start})
+			i++
+		case r == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]):
+			tokens = append(tokens, queryToken{kind: tokenNot, position: start})
+			i++
+		case r == '"':
+			text, err := readQuoted()
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, queryToken{kind: tokenPhrase, position: start, text: text})
+		default:
+			rest := string(runes[i:])
+			if field := fieldPattern.FindStringSubmatch(rest); field != nil {
+				i += len([]rune(field[0]))
+				var value string
+				if i < len(runes) && runes[i] == '"' {
+					var err error
+					value, err = readQuoted()
+					if err != nil {
+						return nil, err
+					}
+				} else {
+					value = readWord()
+				}
+				tokens = append(tokens, queryToken{kind: tokenField, position: start, text: strings.ToLower(field[1]), op: field[2], value: value})
+				continue
+			}
+			word := readWord()
+			switch word {
+			case "NOT":
+				tokens = append(tokens, queryToken{kind: tokenNot, position: start})
+			case "OR":
+				tokens = append(tokens, queryToken{kind: tokenOr, position: start})
+			default:
+				tokens = append(tokens, queryToken{kind: tokenWord, position: start, text: word})
+			}
+		}
+	}
+	return tokens, nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	next   int
+	length int
+}
+
+// parseQuery turns a search box's contents into something that can be
+// matched against index entries
+func parseQuery(query string) (queryNode, error) {
+	tokens, err := tokenizeQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, queryErrorf(0, "the search is empty")
+	}
+	parser := &queryParser{tokens: tokens, length: len([]rune(query))}
+	node, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token, ok := parser.peek(); ok {
+		return nil, queryErrorf(token.position, "there's a closing bracket without an opening one")
+	}
+	return node, nil
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.next >= len(p.tokens) {
+		return queryToken{}, false
+	}
+	return p.tokens[p.next], true
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	nodes := orQuery{first}
+	for {
+		token, ok := p.peek()
+		if !ok || token.kind != tokenOr {
+			break
+		}
+		p.next++
+		node, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	if len(nodes) == 1 {
+		return first, nil
+	}
+	return nodes, nil
+}
+
+func (p *queryParser) parseAnd() (queryNode, error) {
+	nodes := andQuery{}
+	for {
+		token, ok := p.peek()
+		if !ok || token.kind == tokenOr || token.kind == tokenClose {
+			break
+		}
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	if len(nodes) == 0 {
+		position := p.length
+		if token, ok := p.peek(); ok {
+			position = token.position
+		}
+		return nil, queryErrorf(position, "expected a search term here")
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+func (p *queryParser) parseUnary() (queryNode, error) {
+	token, _ := p.peek()
+	p.next++
+	switch token.kind {
+	case tokenNot:
+		if next, ok := p.peek(); !ok || next.kind == tokenOr || next.kind == tokenClose {
+			return nil, queryErrorf(token.position, "there's nothing after this to leave out")
+		}
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notQuery{node}, nil
+	case tokenOpen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing, ok := p.peek(); !ok || closing.kind != tokenClose {
+			return nil, queryErrorf(token.position, "this bracket is never closed")
+		}
+		p.next++
+		return node, nil
+	case tokenField:
+		return parseFieldQuery(token)
+	}
+	if token.kind == tokenPhrase {
+		return textQuery{text: strings.ToLower(token.text), phrase: true}, nil
+	}
+	words := searchTokens(token.text)
+	if len(words) == 0 {
+		// nothing but punctuation, which names are still searched for
+		return textQuery{text: strings.ToLower(token.text), phrase: true}, nil
+	}
+	if len(words) == 1 {
+		return textQuery{text: words[0]}, nil
+	}
+	nodes := andQuery{}
+	for _, word := range words {
+		nodes = append(nodes, textQuery{text: word})
+	}
+	return nodes, nil
+}
+
+var sizeUnits = map[string]float64{
+	"":   1,
+	"b":  1,
+	"kb": 1 << 10,
+	"mb": 1 << 20,
+	"gb": 1 << 30,
+	"tb": 1 << 40,
+}
+
+var sizePattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([a-zA-Z]*)$`)
+
+func parseFieldQuery(token queryToken) (queryNode, error) {
+	q := fieldQuery{field: token.text, op: token.op, value: token.value}
+	example, known := queryFields[q.field]
+	if !known {
+		return nil, queryErrorf(token.position, "there's no %q to search by, try one of %s", q.field, queryFieldNames())
+	}
+	if q.value == "" {
+		return nil, queryErrorf(token.position, "%s needs a value, like %s", q.field, example)
+	}
+	if q.op == "=" {
+		q.op = ":"
+	}
+	wrong := func(what string) error {
+		return queryErrorf(token.position, "%s needs %s, like %s, not %q", q.field, what, example, q.value)
+	}
+	switch q.field {
+	case "type", "ext", "camera", "in":
+		if q.op != ":" {
+			return nil, queryErrorf(token.position, "%s can only be matched with a colon, like %s", q.field, example)
+		}
+	}
+
+	switch q.field {
+	case "type":
+		q.value = strings.ToLower(q.value)
+		types := append(slices.Clone(galleryTypes), "directory")
+		if !slices.Contains(types, q.value) {
+			return nil, queryErrorf(token.position, "type can be %s, not %q", strings.Join(types, ", "), q.value)
+		}
+	case "ext":
+		q.value = strings.ToLower(strings.TrimPrefix(q.value, "."))
+	case "camera":
+		q.value = strings.ToLower(q.value)
+	case "in":
+		q.value = mediaPath(q.value)
+	case "size":
+		match := sizePattern.FindStringSubmatch(q.value)
+		if match == nil {
+			return nil, wrong("a number with an optional unit")
+		}
+		unit, ok := sizeUnits[strings.ToLower(match[2])]
+		if !ok {
+			return nil, queryErrorf(token.position, "size units are B, KB, MB, GB or TB, not %q", match[2])
+		}
+		number, _ := strconv.ParseFloat(match[1], 64)
+		q.number = number * unit
+	case "duration":
+		seconds, err := parseQueryDuration(q.value)
+		if err != nil {
+			return nil, wrong("a length of time")
+		}
+		q.number = seconds
+	case "width", "height":
+		number, err := strconv.Atoi(q.value)
+		if err != nil || number < 0 {
+			return nil, wrong("a number of pixels")
+		}
+		q.number = float64(number)
+	case "taken":
+		from, to, err := parseQueryPeriod(q.value)
+		if err != nil {
+			return nil, wrong("a year, month or day")
+		}
+		q.from, q.to = from, to
+	}
+	return q, nil
+}
+
+// parseQueryDuration reads 90, 90s, 5m, 1h30m or 1:30:00 as seconds
+func parseQueryDuration(value string) (float64, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return seconds, nil
+	}
+	if strings.Contains(value, ":") {
+		seconds := 0.0
+		for _, part := range strings.Split(value, ":") {
+			number, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, err
+			}
+			seconds = seconds*60 + float64(number)
+		}
+		return seconds, nil
+	}
+	duration, err := time.ParseDuration(strings.ToLower(value))
+	if err != nil {
+		return 0, err
+	}
+	return duration.Seconds(), nil
+}
+
+// parseQueryPeriod reads 2023, 2023-06 or 2023-06-14 as the period it covers
+func parseQueryPeriod(value string) (time.Time, time.Time, error) {
+	for _, layout := range []struct {
+		format string
+		years  int
+		months int
+		days   int
+	}{
+		{"2006", 1, 0, 0},
+		{"2006-01", 0, 1, 0},
+		{"2006-01-02", 0, 0, 1},
+	} {
+		from, err := time.ParseInLocation(layout.format, value, time.Local)
+		if err == nil {
+			return from, from.AddDate(layout.years, layout.months, layout.days), nil
+		}
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("%q isn't a date", value)
+}
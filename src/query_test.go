@@ -0,0 +1,109 @@
+package main
+
+import (
+	"html/template"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseQuery(t *testing.T) {
+	cases := map[string]string{
+		`beach`:                          `"beach"`,
+		`"sunset walk" type:video`:       `(and "sunset walk" type:"video")`,
+		`-ext:MOV camera:"Pixel 7"`:      `(and (not ext:"mov") camera:"pixel 7")`,
+		`a OR b c`:                       `(or "a" (and "b" "c"))`,
+		`NOT (in:holidays OR size>=1KB)`: `(not (or in:"/holidays" size>="1KB"))`,
+		`duration=5m`:                    `duration:"5m"`,
+	}
+	for query, expected := range cases {
+		node, err := parseQuery(query)
+		if err != nil {
+			t.Errorf("Expected %q to parse, but got %v", query, err)
+			continue
+		}
+		if node.String() != expected {
+			t.Errorf("Expected %q to parse as %s, but got %s", query, expected, node)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	cases := map[string]string{
+		`"beach`:        "this quote is never closed (at character 1)",
+		`colour:red`:    `there's no "colour" to search by`,
+		`size>big`:      `size needs a number with an optional unit, like size>10MB, not "big"`,
+		`size>10XB`:     `size units are B, KB, MB, GB or TB, not "XB"`,
+		`type>video`:    "type can only be matched with a colon",
+		`type:song`:     `type can be image, video, audio, other, directory, not "song"`,
+		`taken:June`:    "taken needs a year, month or day",
+		`(beach`:        "this bracket is never closed",
+		`beach)`:        "there's a closing bracket without an opening one (at character 6)",
+		`beach OR`:      "expected a search term here (at character 9)",
+		`beach NOT`:     "there's nothing after this to leave out",
+		`width:`:        "width needs a value, like width>=4000",
+		`duration>ages`: "duration needs a length of time",
+		`height>=-10`:   "height needs a number of pixels",
+	}
+	for query, expected := range cases {
+		_, err := parseQuery(query)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q to fail with %q, but got %v", query, expected, err)
+		}
+	}
+}
+
+func TestQueryMatch(t *testing.T) {
+	taken := time.Date(2023, 6, 14, 12, 0, 0, 0, time.Local)
+	photo := IndexEntry{
+		Path: "/holidays/Beach.JPG", Name: "Beach.JPG", Type: "image", Size: 12 << 20,
+		Width: 4032, Height: 3024, ModTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local),
+		Metadata: &MediaMetadata{Image: &ImageMetadata{Camera: "Google Pixel 7", CapturedAt: &taken}},
+	}
+	video := IndexEntry{
+		Path: "/clips/beach walk.mp4", Name: "beach walk.mp4", Type: "video", Size: 300 << 20,
+		Duration: 400, Width: 1920, Height: 1080, ModTime: time.Date(2022, 3, 1, 0, 0, 0, 0, time.Local),
+	}
+	folder := IndexEntry{Path: "/holidays", Name: "holidays", IsDir: true, Type: "directory"}
+	cases := map[string][]bool{
+		// photo, video, folder
+		`beach`:                 {true, true, false},
+		`"beach walk"`:          {false, true, false},
+		`type:video`:            {false, true, false},
+		`type:directory`:        {false, false, true},
+		`ext:jpg`:               {true, false, false},
+		`size>10MB`:             {true, true, false},
+		`size<100MB`:            {true, false, false},
+		`taken:2023-06`:         {true, false, false},
+		`taken<2023`:            {false, true, false},
+		`duration>5m`:           {false, true, false},
+		`duration>=1:00:00`:     {false, false, false},
+		`width>=4000`:           {true, false, false},
+		`camera:"Pixel 7"`:      {true, false, false},
+		`in:/holidays`:          {true, false, false},
+		`beach -type:image`:     {false, true, false},
+		`type:image OR holiday`: {true, false, true},
+	}
+	for query, expected := range cases {
+		node, err := parseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, entry := range []IndexEntry{photo, video, folder} {
+			if node.match(entry) != expected[i] {
+				t.Errorf("Expected %q matching %s to be %v", query, entry.Path, expected[i])
+			}
+		}
+	}
+}
+
+func TestSearchShowsQueryErrors(t *testing.T) {
+	templates := template.Must(template.New("").Parse(`{{ define "baseHTML" }}{{ .GalleryData.QueryError }}{{ end }}`))
+	hdlr := RequestHandlers{MediaDirectory: t.TempDir(), Templates: templates}
+	rec := httptest.NewRecorder()
+	hdlr.performSearch(rec, httptest.NewRequest("GET", "/_search/?query=size%3Ehuge", nil))
+	if !strings.Contains(rec.Body.String(), "size needs a number") {
+		t.Errorf("Expected the query error to be shown, but got %s", rec.Body.String())
+	}
+}
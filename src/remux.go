@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// How a video gets to the browser, cheapest first
+const (
+	playbackDirect    = "direct"
+	playbackRemux     = "remux"
+	playbackTranscode = "transcode"
+)
+
+var (
+	// Codecs browsers can play out of an mp4, anything else means
+	// transcoding. Only 8 bit 4:2:0 h264 decodes everywhere.
+	remuxVideoCodecs  = []string{"h264"}
+	remuxPixelFormats = []string{"yuv420p", "yuvj420p"}
+	// Audio in other codecs (ac3, dts, flac, ...) is cheap to re-encode, so
+	// doesn't stop a remux on its own
+	remuxAudioCodecs = []string{"aac", "mp3"}
+)
+
+// playbackMode is how a video with this path and probe should be played,
+// browsers play the streamable formats as they are, other containers with
+// browser friendly codecs are remuxed and the rest go through hls
+func playbackMode(path string, probe FFMpegProbe) string {
+	if isStreamable(path) {
+		return playbackDirect
+	}
+	if canRemux(probe) {
+		return playbackRemux
+	}
+	return playbackTranscode
+}
+
+// canRemux is whether the video stream can be copied as is into an mp4
+func canRemux(probe FFMpegProbe) bool {
+	for _, stream := range probe.Streams {
+		if stream.CodecType == "video" {
+			return slices.Contains(remuxVideoCodecs, stream.CodecName) && slices.Contains(remuxPixelFormats, stream.PixelFormat)
+		}
+	}
+	return false
+}
+
+// audioNeedsEncoding is whether an audio stream has to be re-encoded to go
+// in a remuxed mp4, -1 meaning the first audio stream
+func audioNeedsEncoding(probe FFMpegProbe, audio int) bool {
+	for _, stream := range probe.Streams {
+		if stream.CodecType == "audio" && (audio < 0 || stream.Index == audio) {
+			return !slices.Contains(remuxAudioCodecs, stream.CodecName)
+		}
+	}
+	return false
+}
+
+// remuxStream copies the video into a fragmented mp4 as it's written out,
+// which can start playing straight away. There's no seeking within the
+// output, instead the player asks again with a start time in seconds.
+func remuxStream(w http.ResponseWriter, r *http.Request, path string, probe FFMpegProbe, audio int) {
+	inputArgs := ffmpeg.KwArgs{}
+	start, err := strconv.ParseFloat(r.URL.Query().Get("start"), 64)
+	if err == nil && start > 0 {
+		inputArgs["ss"] = fmt.Sprintf("%f", start)
+	}
+	outputArgs := ffmpeg.KwArgs{
+		"map":      []string{"0:v:0", audioMap(audio)},
+		"c:v":      "copy",
+		"c:a":      "copy",
+		"movflags": "frag_keyframe+empty_moov+default_base_moof",
+		"f":        "mp4",
+	}
+	if audioNeedsEncoding(probe, audio) {
+		outputArgs["c:a"] = "aac"
+		outputArgs["b:a"] = "192k"
+		outputArgs["ac"] = "2"
+	}
+
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Accept-Ranges", "none")
+	w.Header().Set("Cache-Control", "no-store")
+	// the context stops ffmpeg when the viewer goes away
+	err = ffmpeg.OutputContext(r.Context(), []*ffmpeg.Stream{ffmpeg.Input(path, inputArgs)}, "pipe:", outputArgs).
+		WithOutput(w).
+		Run()
+	if err != nil && r.Context().Err() == nil {
+		fmt.Println("Error remuxing video:", err)
+	}
+}
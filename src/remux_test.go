@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestPlaybackMode(t *testing.T) {
+	h264 := FFMpegProbe{Streams: []FFMPegStreamFormat{
+		{CodecType: "video", CodecName: "h264", PixelFormat: "yuv420p"},
+		{CodecType: "audio", CodecName: "ac3"},
+	}}
+	tenBit := FFMpegProbe{Streams: []FFMPegStreamFormat{
+		{CodecType: "video", CodecName: "h264", PixelFormat: "yuv420p10le"},
+	}}
+	hevc := FFMpegProbe{Streams: []FFMPegStreamFormat{
+		{CodecType: "video", CodecName: "hevc", PixelFormat: "yuv420p"},
+	}}
+	cases := []struct {
+		path     string
+		probe    FFMpegProbe
+		expected string
+	}{
+		{"/a.mp4", hevc, playbackDirect},
+		{"/a.mkv", h264, playbackRemux},
+		{"/a.MOV", h264, playbackRemux},
+		{"/a.mkv", tenBit, playbackTranscode},
+		{"/a.avi", hevc, playbackTranscode},
+		{"/a.mkv", FFMpegProbe{}, playbackTranscode},
+	}
+	for _, c := range cases {
+		if mode := playbackMode(c.path, c.probe); mode != c.expected {
+			t.Errorf("Expected %s for %s, but got %s", c.expected, c.path, mode)
+		}
+	}
+	if !audioNeedsEncoding(h264, -1) {
+		t.Errorf("Expected ac3 audio to need encoding")
+	}
+}
+
+func TestStreamSource(t *testing.T) {
+	src, typ := streamSource("/films/a.mp4", "video/mp4", playbackDirect)
+	if src != "/_stream/films/a.mp4" || typ != "video/mp4" {
+		t.Errorf("Expected to stream mp4 directly, but got %s %s", src, typ)
+	}
+	src, typ = streamSource("/films/a.mkv", "video/x-matroska", playbackRemux)
+	if src != "/_stream/films/a.mkv" || typ != "video/mp4" {
+		t.Errorf("Expected a remuxed mp4, but got %s %s", src, typ)
+	}
+	src, typ = streamSource("/films/a.mkv", "video/x-matroska", playbackTranscode)
+	if src != "/_hls/films/a.mkv" || typ != "application/x-mpegURL" {
+		t.Errorf("Expected hls for mkv, but got %s %s", src, typ)
+	}
+}
+
+func TestAudioTracks(t *testing.T) {
+	probe := FFMpegProbe{Streams: []FFMPegStreamFormat{
+		{Index: 0, CodecType: "video", CodecName: "h264", PixelFormat: "yuv420p"},
+		{Index: 1, CodecType: "audio", CodecName: "aac", Tags: FFMPegStreamTags{Language: "eng"}},
+		{Index: 2, CodecType: "audio", CodecName: "ac3", Tags: FFMPegStreamTags{Language: "jpn", Title: "Original"}},
+		{Index: 3, CodecType: "audio", CodecName: "aac"},
+	}}
+	tracks := audioTracks("/a b.mp4", probe, "/_stream/a b.mp4", "video/mp4", playbackDirect)
+	expected := []AudioTrack{
+		{Label: "English", Source: "/_stream/a%20b.mp4", Type: "video/mp4"},
+		{Label: "Japanese - Original", Source: "/_stream/a%20b.mp4?audio=2", Type: "video/mp4", Remux: true},
+		{Label: "Track 3", Source: "/_stream/a%20b.mp4?audio=3", Type: "video/mp4", Remux: true},
+	}
+	if len(tracks) != len(expected) {
+		t.Fatalf("Expected %+v, but got %+v", expected, tracks)
+	}
+	for i := range expected {
+		if tracks[i] != expected[i] {
+			t.Errorf("Expected %+v, but got %+v", expected[i], tracks[i])
+		}
+	}
+
+	for query, expected := range map[string]int{"": -1, "audio=2": 2, "audio=0": -2, "audio=x": -2} {
+		values, _ := url.ParseQuery(query)
+		audio, ok := audioStream(probe, values)
+		if !ok {
+			audio = -2
+		}
+		if audio != expected {
+			t.Errorf("Expected %d for %q, but got %d", expected, query, audio)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"strings"
+	"unicode"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// termsBucket is the inverted index, a bucket per search term holding the
+// paths of everything with that term in its name, captions or folders
+var termsBucket = []byte("terms")
+
+// termLengthsBucket has every term keyed by its length first, so typos
+// only have to be checked against terms about as long as the word
+var termLengthsBucket = []byte("termLengths")
+
+func termLengthKey(length int, term string) []byte {
+	key := binary.BigEndian.AppendUint16(nil, uint16(min(length, 0xffff)))
+	return append(key, term...)
+}
+
+// where a term was found, an entry's terms are a bitmask of these
+const (
+	termInName = 1 << iota
+	termInCaption
+	termInPath
+)
+
+// match scores for a search word against a term, by where the term is.
+// Names beat captions beat folders, and within each an exact word beats a
+// prefix beats a typo.
+var (
+	nameScores    = [4]int{0, 10, 20, 30}
+	captionScores = [4]int{0, 2, 4, 6}
+	pathScore     = 1
+	// exactNameScore is for a name that's exactly what was searched for
+	exactNameScore = 100
+)
+
+const (
+	noMatch = iota
+	fuzzyMatch
+	prefixMatch
+	exactMatch
+)
+
+// searchTokens splits text into lowercase words, breaking between letters
+// and numbers too so IMG_2034 is "img" and "2034"
+func searchTokens(text string) []string {
+	tokens := []string{}
+	current := []rune{}
+	flush := func() {
+		if len(current) > 0 {
+			tokens = append(tokens, string(current))
+			current = current[:0]
+		}
+	}
+	for _, r := range strings.ToLower(text) {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			flush()
+			continue
+		}
+		if len(current) > 0 && unicode.IsDigit(r) != unicode.IsDigit(current[len(current)-1]) {
+			flush()
+		}
+		current = append(current, r)
+	}
+	flush()
+	return tokens
+}
+
+// nameStem is a file's name without its extension
+func nameStem(entry IndexEntry) string {
+	if entry.IsDir {
+		return entry.Name
+	}
+	return strings.TrimSuffix(entry.Name, pathExt(entry.Name))
+}
+
+// captions are the descriptive text embedded in a photo
+func captions(entry IndexEntry) []string {
+	photo := entryImageMetadata(entry)
+	if photo == nil {
+		return nil
+	}
+	return append([]string{photo.Title, photo.Description}, photo.Keywords...)
+}
+
+// entryTerms are the words an entry can be found by, and where they are
+func entryTerms(entry IndexEntry) map[string]int {
+	terms := map[string]int{}
+	if entry.Path == "/" {
+		return terms
+	}
+	// the extension counts as part of the name, so beans.jpg finds itself
+	for _, token := range searchTokens(entry.Name) {
+		terms[token] |= termInName
+	}
+	for _, caption := range captions(entry) {
+		for _, token := range searchTokens(caption) {
+			terms[token] |= termInCaption
+		}
+	}
+	for _, token := range searchTokens(parentPath(entry.Path)) {
+		terms[token] |= termInPath
+	}
+	return terms
+}
+
+// typoTolerance is how many edits a word can be from a term and still
+// match it, short words have to be spelt right
+func typoTolerance(word string) int {
+	length := len([]rune(word))
+	switch {
+	case length <= 3:
+		return 0
+	case length <= 7:
+		return 1
+	}
+	return 2
+}
+
+// matchWord is how well a search word matches a term
+func matchWord(term string, word string) int {
+	switch {
+	case term == word:
+		return exactMatch
+	case strings.HasPrefix(term, word):
+		return prefixMatch
+	}
+	tolerance := typoTolerance(word)
+	if tolerance > 0 && editDistance(term, word, tolerance) <= tolerance {
+		return fuzzyMatch
+	}
+	return noMatch
+}
+
+// editDistance counts the insertions, deletions, substitutions and swaps
+// of neighbouring letters between a and b, giving up past limit
+func editDistance(a string, b string, limit int) int {
+	s, t := []rune(a), []rune(b)
+	if abs(len(s)-len(t)) > limit {
+		return limit + 1
+	}
+	previous2 := make([]int, len(t)+1)
+	previous := make([]int, len(t)+1)
+	current := make([]int, len(t)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		current[0] = i
+		smallest := current[0]
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				current[j] = min(current[j], previous2[j-2]+1)
+			}
+			smallest = min(smallest, current[j])
+		}
+		if smallest > limit {
+			return limit + 1
+		}
+		previous2, previous, current = previous, current, previous2
+	}
+	return previous[len(t)]
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// wordScore is how well an entry matches one search word, 0 if it doesn't
+func wordScore(terms map[string]int, word string) int {
+	best := 0
+	for term, where := range terms {
+		match := matchWord(term, word)
+		if match == noMatch {
+			continue
+		}
+		score := 0
+		if where&termInName != 0 {
+			score = max(score, nameScores[match])
+		}
+		if where&termInCaption != 0 {
+			score = max(score, captionScores[match])
+		}
+		if where&termInPath != 0 {
+			score = max(score, pathScore)
+		}
+		best = max(best, score)
+	}
+	return best
+}
+
+// searchScore ranks an entry for the words searched for
+func searchScore(entry IndexEntry, words []string) int {
+	if len(words) == 0 {
+		return 0
+	}
+	terms := entryTerms(entry)
+	total := 0
+	for _, word := range words {
+		total += wordScore(terms, word)
+	}
+	searched := strings.Join(words, " ")
+	if strings.Join(searchTokens(nameStem(entry)), " ") == searched || strings.Join(searchTokens(entry.Name), " ") == searched {
+		total += exactNameScore
+	}
+	return total
+}
+
+func indexTerms(tx *bolt.Tx, entry IndexEntry) error {
+	terms := tx.Bucket(termsBucket)
+	for term := range entryTerms(entry) {
+		bucket, err := terms.CreateBucketIfNotExists([]byte(term))
+		if err != nil {
+			return err
+		}
+		err = bucket.Put([]byte(entry.Path), nil)
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(termLengthsBucket).Put(termLengthKey(len([]rune(term)), term), nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexTerms removes a stored entry from the inverted index
+func unindexTerms(tx *bolt.Tx, data []byte) error {
+	var entry IndexEntry
+	if json.Unmarshal(data, &entry) != nil {
+		return nil
+	}
+	terms := tx.Bucket(termsBucket)
+	for term := range entryTerms(entry) {
+		bucket := terms.Bucket([]byte(term))
+		if bucket == nil {
+			continue
+		}
+		err := bucket.Delete([]byte(entry.Path))
+		if err != nil {
+			return err
+		}
+		if k, _ := bucket.Cursor().First(); k == nil {
+			err = terms.DeleteBucket([]byte(term))
+			if err == nil {
+				err = tx.Bucket(termLengthsBucket).Delete(termLengthKey(len([]rune(term)), term))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Candidates are the paths under root that match every word in some way,
+// looked up in the inverted index
+func (idx *LibraryIndex) Candidates(root string, words []string) []string {
+	root = mediaPath(root)
+	prefix := []byte(strings.TrimSuffix(root, "/") + "/")
+	var found map[string]bool
+	idx.db.View(func(tx *bolt.Tx) error {
+		terms := tx.Bucket(termsBucket)
+		for _, word := range words {
+			paths := map[string]bool{}
+			collect := func(term []byte) {
+				c := terms.Bucket(term).Cursor()
+				for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+					if found == nil || found[string(k)] {
+						paths[string(k)] = true
+					}
+				}
+			}
+			// exact and prefix matches sort together
+			c := terms.Cursor()
+			for k, _ := c.Seek([]byte(word)); k != nil && bytes.HasPrefix(k, []byte(word)); k, _ = c.Next() {
+				collect(k)
+			}
+			// typos are only looked for in terms within the tolerance of
+			// the word's length, anything longer or shorter can't match
+			if tolerance := typoTolerance(word); tolerance > 0 {
+				length := len([]rune(word))
+				last := termLengthKey(length+tolerance+1, "")
+				c := tx.Bucket(termLengthsBucket).Cursor()
+				for k, _ := c.Seek(termLengthKey(length-tolerance, "")); k != nil && bytes.Compare(k, last) < 0; k, _ = c.Next() {
+					if term := k[2:]; !bytes.HasPrefix(term, []byte(word)) && matchWord(string(term), word) != noMatch {
+						collect(term)
+					}
+				}
+			}
+			found = paths
+			if len(found) == 0 {
+				break
+			}
+		}
+		return nil
+	})
+	paths := []string{}
+	for p := range found {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// searchWords are the words a query ranks by, and the ones every result
+// has to match, which the inverted index can narrow things down by
+func searchWords(node queryNode) (ranking []string, required []string) {
+	var visit func(node queryNode, top bool)
+	visit = func(node queryNode, top bool) {
+		switch q := node.(type) {
+		case andQuery:
+			for _, child := range q {
+				visit(child, top)
+			}
+		case orQuery:
+			for _, child := range q {
+				visit(child, false)
+			}
+		case textQuery:
+			if q.phrase {
+				return
+			}
+			ranking = append(ranking, q.text)
+			if top {
+				required = append(required, q.text)
+			}
+		}
+		// anything left out doesn't count towards ranking
+	}
+	visit(node, true)
+	return ranking, required
+}
+
+// search finds everything under root matching query, best matches first
+func (hdlr RequestHandlers) search(root string, fp string, query queryNode) ([]IndexEntry, error) {
+	ranking, required := searchWords(query)
+	results := []IndexEntry{}
+	collect := func(entry IndexEntry) error {
+		if query.match(entry) {
+			results = append(results, entry)
+		}
+		return nil
+	}
+	var err error
+	switch {
+	case hdlr.Index.Ready() && len(required) > 0:
+		for _, p := range hdlr.Index.Candidates(root, required) {
+			if entry, found := hdlr.Index.Get(p); found {
+				collect(entry)
+			}
+		}
+	case hdlr.Index.Ready():
+		err = hdlr.Index.Walk(root, collect)
+	default:
+		err = hdlr.walkSearch(fp, collect)
+	}
+	scores := map[string]int{}
+	for _, entry := range results {
+		scores[entry.Path] = searchScore(entry, ranking)
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if scores[results[i].Path] != scores[results[j].Path] {
+			return scores[results[i].Path] > scores[results[j].Path]
+		}
+		return results[i].Path < results[j].Path
+	})
+	return results, err
+}
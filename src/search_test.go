@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestSearchTokens(t *testing.T) {
+	tokens := searchTokens("IMG_2034 Sunset-walk (final)")
+	if strings.Join(tokens, ",") != "img,2034,sunset,walk,final" {
+		t.Errorf("Expected img,2034,sunset,walk,final, but got %v", tokens)
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"holiday", "holiday", 0},
+		{"holiday", "holidya", 1},
+		{"holiday", "hollday", 1},
+		{"holiday", "holidays", 1},
+		{"holiday", "olida", 2},
+		{"holiday", "birthday", 3},
+	}
+	for _, c := range cases {
+		if distance := editDistance(c.a, c.b, 2); distance != c.expected {
+			t.Errorf("Expected %s to %s to be %d, but got %d", c.a, c.b, c.expected, distance)
+		}
+	}
+}
+
+func TestSearchRanking(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"beach.png",
+		"beaches at dawn.png",
+		"baech.png",
+		"beach/sand.png",
+		"forest.png",
+	} {
+		writeTestPng(t, filepath.Join(dir, name), 10, 10)
+	}
+	idx := openTestIndex(t, dir)
+	if err := idx.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	hdlr := RequestHandlers{MediaDirectory: dir, Index: idx}
+	query, _ := parseQuery("beach")
+	results, err := hdlr.search("/", dir, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{}
+	for _, entry := range results {
+		paths = append(paths, entry.Path)
+	}
+	// the beach folder and beach.png are both exact, then the prefix, the
+	// typo and finally what's in the beach folder
+	expected := "/beach,/beach.png,/beaches at dawn.png,/baech.png,/beach/sand.png"
+	if strings.Join(paths, ",") != expected {
+		t.Errorf("Expected %s, but got %s", expected, strings.Join(paths, ","))
+	}
+
+	// the same without the index
+	results, _ = RequestHandlers{MediaDirectory: dir, ReadDir: os.ReadDir}.search("/", dir, query)
+	if len(results) != len(paths) {
+		t.Errorf("Expected %d results from walking, but got %d", len(paths), len(results))
+	}
+}
+
+func TestSearchCaptions(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPng(t, filepath.Join(dir, "IMG_0001.png"), 10, 10)
+	idx := openTestIndex(t, dir)
+	taken := time.Now()
+	entry := IndexEntry{
+		Path: "/IMG_0001.png", Name: "IMG_0001.png", Type: "image", Version: indexVersion,
+		Metadata: &MediaMetadata{Image: &ImageMetadata{Title: "Lighthouse at dusk", CapturedAt: &taken}},
+	}
+	if err := idx.put(entry); err != nil {
+		t.Fatal(err)
+	}
+	if paths := idx.Candidates("/", []string{"lighthuose"}); len(paths) != 1 {
+		t.Errorf("Expected the caption to be found despite the typo, but got %v", paths)
+	}
+	entry.Metadata.Image.Title = "Harbour"
+	idx.put(entry)
+	if paths := idx.Candidates("/", []string{"lighthouse"}); len(paths) != 0 {
+		t.Errorf("Expected the old caption to be gone, but got %v", paths)
+	}
+	idx.db.Update(func(tx *bolt.Tx) error {
+		return deleteTree(tx, "/IMG_0001.png")
+	})
+	if paths := idx.Candidates("/", []string{"harbour"}); len(paths) != 0 {
+		t.Errorf("Expected deleted entries to leave the inverted index, but got %v", paths)
+	}
+	idx.db.View(func(tx *bolt.Tx) error {
+		if k, _ := tx.Bucket(termLengthsBucket).Cursor().First(); k != nil {
+			t.Errorf("Expected the terms to be gone from the lengths too, but got %q", k)
+		}
+		return nil
+	})
+}
+
+func TestSearchByNameWithExtension(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"beans.jpg", "4.1.01.png", "peas.png"} {
+		writeTestPng(t, filepath.Join(dir, name), 10, 10)
+	}
+	idx := openTestIndex(t, dir)
+	if err := idx.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		"beans.jpg":  "/beans.jpg",
+		"beans.JPG":  "/beans.jpg",
+		"jpg":        "/beans.jpg",
+		"4.1.01.png": "/4.1.01.png",
+	}
+	for _, hdlr := range []RequestHandlers{{MediaDirectory: dir, Index: idx}, {MediaDirectory: dir, ReadDir: os.ReadDir}} {
+		for search, expected := range cases {
+			query, _ := parseQuery(search)
+			results, err := hdlr.search("/", dir, query)
+			if err != nil || len(results) != 1 || results[0].Path != expected {
+				t.Errorf("Expected %s to find %s, but got %+v %v", search, expected, results, err)
+			}
+		}
+	}
+}
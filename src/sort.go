@@ -0,0 +1,188 @@
+package main
+
+import (
+	"hash/fnv"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type SortOption struct {
+	Value, Label string
+}
+
+// sortOptions are what the gallery can be ordered by, searches can also be
+// ordered by relevance
+var sortOptions = []SortOption{
+	{"name", "Name"},
+	{"mtime", "Modified"},
+	{"size", "Size"},
+	{"taken", "Taken"},
+	{"duration", "Duration"},
+	{"random", "Random"},
+}
+
+var relevanceSort = SortOption{"relevance", "Relevance"}
+
+// Sorting is how a gallery page is ordered. Seed keeps a random order the
+// same from one page to the next.
+type Sorting struct {
+	By    string
+	Order string
+	Seed  int64
+}
+
+// indexedSorts need what the index reads from inside files, a stat can't
+// tell them apart so they're only offered once the library is indexed
+var indexedSorts = []string{"taken", "duration"}
+
+// availableSortOptions are the orders worth offering, searches start with
+// relevance
+func availableSortOptions(indexed bool, search bool) []SortOption {
+	options := []SortOption{}
+	if search {
+		options = append(options, relevanceSort)
+	}
+	for _, option := range sortOptions {
+		if indexed || !slices.Contains(indexedSorts, option.Value) {
+			options = append(options, option)
+		}
+	}
+	return options
+}
+
+// readSorting reads the sort, order and seed parameters, anything that
+// isn't one of the options gets the first of them
+func readSorting(query url.Values, options []SortOption) Sorting {
+	sorting := Sorting{By: query.Get("sort"), Order: query.Get("order")}
+	valid := slices.ContainsFunc(options, func(option SortOption) bool {
+		return option.Value == sorting.By
+	})
+	if !valid {
+		sorting.By = options[0].Value
+	}
+	if sorting.Order != "asc" && sorting.Order != "desc" {
+		// names read a to z, everything else is most interesting first
+		sorting.Order = "desc"
+		if sorting.By == "name" {
+			sorting.Order = "asc"
+		}
+	}
+	if sorting.By == "random" {
+		seed, err := strconv.ParseInt(query.Get("seed"), 10, 64)
+		if err != nil {
+			seed = time.Now().UnixNano()
+		}
+		sorting.Seed = seed
+	}
+	return sorting
+}
+
+// needsStat is whether sorting needs to know more than a name
+func (sorting Sorting) needsStat() bool {
+	return sorting.By == "mtime" || sorting.By == "size"
+}
+
+// Values are the parameters that ask for this order again
+func (sorting Sorting) Values() url.Values {
+	values := url.Values{"sort": {sorting.By}, "order": {sorting.Order}}
+	if sorting.By == "random" {
+		values.Set("seed", strconv.FormatInt(sorting.Seed, 10))
+	}
+	return values
+}
+
+// naturalLess compares names the way people do, ignoring case and with
+// runs of digits compared as numbers, so img2 comes before img10
+func naturalLess(a string, b string) bool {
+	return naturalCompare(a, b) < 0
+}
+
+func naturalCompare(a string, b string) int {
+	s, t := []rune(strings.ToLower(a)), []rune(strings.ToLower(b))
+	i, j := 0, 0
+	for i < len(s) && j < len(t) {
+		if unicode.IsDigit(s[i]) && unicode.IsDigit(t[j]) {
+			si, tj := i, j
+			for i < len(s) && unicode.IsDigit(s[i]) {
+				i++
+			}
+			for j < len(t) && unicode.IsDigit(t[j]) {
+				j++
+			}
+			x := strings.TrimLeft(string(s[si:i]), "0")
+			y := strings.TrimLeft(string(t[tj:j]), "0")
+			if len(x) != len(y) {
+				return len(x) - len(y)
+			}
+			if x != y {
+				return strings.Compare(x, y)
+			}
+			continue
+		}
+		if s[i] != t[j] {
+			return int(s[i]) - int(t[j])
+		}
+		i++
+		j++
+	}
+	if c := (len(s) - i) - (len(t) - j); c != 0 {
+		return c
+	}
+	// only differ by case or leading zeros, keep it stable
+	return strings.Compare(a, b)
+}
+
+func shuffleKey(seed int64, path string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(strconv.FormatInt(seed, 10)))
+	h.Write([]byte(path))
+	return h.Sum64()
+}
+
+// sortEntries orders entries, ties are broken by name. Relevance leaves
+// them in the order they're in.
+func sortEntries(entries []IndexEntry, sorting Sorting) {
+	if sorting.By == relevanceSort.Value {
+		return
+	}
+	compare := func(a IndexEntry, b IndexEntry) int {
+		switch sorting.By {
+		case "mtime":
+			return a.ModTime.Compare(b.ModTime)
+		case "size":
+			return compareInts(a.Size, b.Size)
+		case "taken":
+			return entryTaken(a).Compare(entryTaken(b))
+		case "duration":
+			return compareInts(int64(a.Duration*1000), int64(b.Duration*1000))
+		case "random":
+			return compareInts(int64(shuffleKey(sorting.Seed, a.Path)>>1), int64(shuffleKey(sorting.Seed, b.Path)>>1))
+		}
+		return naturalCompare(a.Name, b.Name)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		c := compare(entries[i], entries[j])
+		if c == 0 {
+			return naturalLess(entries[i].Name, entries[j].Name)
+		}
+		if sorting.Order == "desc" {
+			return c > 0
+		}
+		return c < 0
+	})
+}
+
+func compareInts(a int64, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
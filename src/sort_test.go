@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNaturalLess(t *testing.T) {
+	names := []string{"img10.jpg", "IMG2.jpg", "img1.jpg", "img02b.jpg", "beach.jpg", "img2a.jpg"}
+	sort.SliceStable(names, func(i, j int) bool { return naturalLess(names[i], names[j]) })
+	expected := "beach.jpg,img1.jpg,IMG2.jpg,img2a.jpg,img02b.jpg,img10.jpg"
+	if strings.Join(names, ",") != expected {
+		t.Errorf("Expected %s, but got %s", expected, strings.Join(names, ","))
+	}
+}
+
+func TestSortEntries(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2023, 1, d, 0, 0, 0, 0, time.UTC) }
+	entries := func() []IndexEntry {
+		return []IndexEntry{
+			{Path: "/b10.png", Name: "b10.png", Size: 30, ModTime: day(1)},
+			{Path: "/a.mp4", Name: "a.mp4", Size: 10, ModTime: day(3), Duration: 90},
+			{Path: "/b9.png", Name: "b9.png", Size: 20, ModTime: day(2)},
+		}
+	}
+	names := func(entries []IndexEntry) string {
+		parts := []string{}
+		for _, entry := range entries {
+			parts = append(parts, entry.Name)
+		}
+		return strings.Join(parts, ",")
+	}
+	cases := map[string]string{
+		"sort=name":                "a.mp4,b9.png,b10.png",
+		"sort=name&order=desc":     "b10.png,b9.png,a.mp4",
+		"sort=mtime":               "a.mp4,b9.png,b10.png",
+		"sort=size&order=asc":      "a.mp4,b9.png,b10.png",
+		"sort=duration":            "a.mp4,b9.png,b10.png",
+		"sort=duration&order=asc":  "b9.png,b10.png,a.mp4",
+		"sort=nonsense&order=what": "a.mp4,b9.png,b10.png",
+	}
+	for params, expected := range cases {
+		query, _ := url.ParseQuery(params)
+		sorted := entries()
+		sortEntries(sorted, readSorting(query, availableSortOptions(true, false)))
+		if names(sorted) != expected {
+			t.Errorf("Expected %s to give %s, but got %s", params, expected, names(sorted))
+		}
+	}
+
+	// random orders are the same from page to page
+	query, _ := url.ParseQuery("sort=random&seed=42")
+	first, second := entries(), entries()
+	sortEntries(first, readSorting(query, availableSortOptions(true, false)))
+	sortEntries(second, readSorting(query, availableSortOptions(true, false)))
+	if names(first) != names(second) {
+		t.Errorf("Expected the same seed to give the same order, but got %s and %s", names(first), names(second))
+	}
+}
+
+func TestNextPageURL(t *testing.T) {
+	query, _ := url.ParseQuery("sort=random&seed=42&order=asc")
+	gallery := GalleryData{URL: "/_search/holidays", Query: "beach", NextPage: 3, Sorting: readSorting(query, availableSortOptions(true, true))}
+	expected := "/_search/holidays?order=asc&pageNum=3&query=beach&seed=42&sort=random"
+	if gallery.NextPageURL() != expected {
+		t.Errorf("Expected %s, but got %s", expected, gallery.NextPageURL())
+	}
+	if sorting := readSorting(url.Values{}, availableSortOptions(true, true)); sorting.By != "relevance" || sorting.Order != "desc" {
+		t.Errorf("Expected searches to go by relevance, but got %+v", sorting)
+	}
+}
+
+func TestSortOptionsWithoutIndex(t *testing.T) {
+	options := availableSortOptions(false, false)
+	for _, option := range options {
+		if option.Value == "taken" || option.Value == "duration" {
+			t.Errorf("Expected %s not to be offered without the index", option.Value)
+		}
+	}
+	if sorting := readSorting(url.Values{"sort": {"duration"}}, options); sorting.By != "name" {
+		t.Errorf("Expected name, but got %s", sorting.By)
+	}
+}
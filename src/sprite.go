@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+var (
+	SPRITE_TILE_WIDTH  = 160
+	SPRITE_TILE_HEIGHT = 90
+	SPRITE_COLUMNS     = 10
+	// SPRITE_MAX_TILES keeps the sheet a sensible size for long films,
+	// short videos get a tile every SPRITE_MIN_INTERVAL seconds
+	SPRITE_MAX_TILES    = 100
+	SPRITE_MIN_INTERVAL = 2.0
+)
+
+// spriteVariant names sprite sheets in the thumbnail cache
+const spriteVariant = "sprite-v1"
+
+// spriteLayout is how a video's sprite sheet is laid out, both ffmpeg and
+// the WebVTT track need to agree on it
+type spriteLayout struct {
+	Interval float64
+	Tiles    int
+	Columns  int
+	Rows     int
+}
+
+func newSpriteLayout(duration float64) spriteLayout {
+	interval := math.Max(duration/float64(SPRITE_MAX_TILES), SPRITE_MIN_INTERVAL)
+	tiles := int(math.Max(1, math.Ceil(duration/interval)))
+	columns := int(math.Min(float64(SPRITE_COLUMNS), float64(tiles)))
+	return spriteLayout{
+		Interval: interval,
+		Tiles:    tiles,
+		Columns:  columns,
+		Rows:     int(math.Ceil(float64(tiles) / float64(columns))),
+	}
+}
+
+// ReadSpriteSheet grabs a frame every layout.Interval seconds into a grid
+// of tiles in a single jpeg. Only keyframes are decoded, which is plenty
+// for seeking previews and far quicker on long videos.
+func ReadSpriteSheet(inFileName string, layout spriteLayout) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	err := ffmpeg.Input(inFileName, ffmpeg.KwArgs{"skip_frame": "nokey"}).
+		Filter("fps", ffmpeg.Args{fmt.Sprintf("1/%f", layout.Interval)}).
+		Filter("scale", ffmpeg.Args{fmt.Sprintf("%d:%d:force_original_aspect_ratio=decrease", SPRITE_TILE_WIDTH, SPRITE_TILE_HEIGHT)}).
+		Filter("pad", ffmpeg.Args{fmt.Sprintf("%d:%d:(ow-iw)/2:(oh-ih)/2", SPRITE_TILE_WIDTH, SPRITE_TILE_HEIGHT)}).
+		Filter("tile", ffmpeg.Args{fmt.Sprintf("%dx%d", layout.Columns, layout.Rows)}).
+		Output("pipe:", ffmpeg.KwArgs{"vframes": 1, "format": "image2", "vcodec": "mjpeg", "q:v": 5}).
+		WithOutput(buf).
+		Run()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func formatVttTimestamp(seconds float64) string {
+	millis := int(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", millis/3600000, millis/60000%60, millis/1000%60, millis%1000)
+}
+
+// SpriteVtt describes where each tile of the sprite sheet is, as a WebVTT
+// thumbnails track
+func SpriteVtt(spriteUrl string, duration float64, layout spriteLayout) string {
+	var vtt strings.Builder
+	vtt.WriteString("WEBVTT\n")
+	for i := 0; i < layout.Tiles; i++ {
+		start := float64(i) * layout.Interval
+		end := math.Min(start+layout.Interval, duration)
+		x := (i % layout.Columns) * SPRITE_TILE_WIDTH
+		y := (i / layout.Columns) * SPRITE_TILE_HEIGHT
+		fmt.Fprintf(&vtt, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			formatVttTimestamp(start), formatVttTimestamp(end), spriteUrl, x, y, SPRITE_TILE_WIDTH, SPRITE_TILE_HEIGHT)
+	}
+	return vtt.String()
+}
+
+// LoadSpriteSheet returns the sprite sheet from the cache, generating it if
+// need be. It shares the ffmpeg budget with video thumbnails.
+func (t *Thumbnailer) LoadSpriteSheet(ctx context.Context, req thumbnailRequest, layout spriteLayout) ([]byte, error) {
+	return t.inFlight.loadDerived(ctx, t.Cache, t.videos, req.path, req.info, spriteVariant, func() ([]byte, error) {
+		return ReadSpriteSheet(req.path, layout)
+	})
+}
+
+// videoLayout stats and probes the video behind a sprite or storyboard
+// request, writing an error response if that isn't possible
+func (hdlr RequestHandlers) videoLayout(w http.ResponseWriter, filepath string) (os.FileInfo, float64, spriteLayout, bool) {
+	st, err := os.Stat(filepath)
+	if err != nil {
+		http.Error(w, "No file found", http.StatusNotFound)
+		return nil, 0, spriteLayout{}, false
+	}
+	prts := strings.Split(filepath, ".")
+	if !slices.Contains(videoExtensions, strings.ToLower(prts[len(prts)-1])) {
+		http.Error(w, "Not a video", http.StatusBadRequest)
+		return nil, 0, spriteLayout{}, false
+	}
+	probe, err := readCachedProbe(filepath, st)
+	if err != nil {
+		http.Error(w, "Error reading video", http.StatusInternalServerError)
+		return nil, 0, spriteLayout{}, false
+	}
+	duration, err := probe.DurationSeconds()
+	if err != nil {
+		http.Error(w, "Error reading video duration", http.StatusInternalServerError)
+		return nil, 0, spriteLayout{}, false
+	}
+	return st, duration, newSpriteLayout(duration), true
+}
+
+func (hdlr RequestHandlers) getSpriteSheet(w http.ResponseWriter, r *http.Request) {
+	filepath := strings.Replace(r.URL.Path, "/_sprite", hdlr.MediaDirectory, 1)
+	st, _, layout, ok := hdlr.videoLayout(w, filepath)
+	if !ok {
+		return
+	}
+	ctx, cancel := hdlr.Thumbnailer.requestContext(r)
+	defer cancel()
+	byts, err := hdlr.Thumbnailer.LoadSpriteSheet(ctx, thumbnailRequest{path: filepath, info: st, isVideo: true}, layout)
+	if err != nil {
+		fmt.Println("Error generating sprite sheet:", err)
+		w.Header().Set("Cache-Control", "no-store")
+		http.Error(w, "Sprite sheet unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeContent(w, r, st.Name(), st.ModTime(), bytes.NewReader(byts))
+}
+
+func (hdlr RequestHandlers) getStoryboard(w http.ResponseWriter, r *http.Request) {
+	mediaPath := strings.Replace(r.URL.Path, "/_storyboard", "", 1)
+	st, duration, layout, ok := hdlr.videoLayout(w, hdlr.MediaDirectory+mediaPath)
+	if !ok {
+		return
+	}
+	spriteUrl := (&url.URL{Path: "/_sprite" + mediaPath}).EscapedPath()
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	http.ServeContent(w, r, st.Name(), st.ModTime(), strings.NewReader(SpriteVtt(spriteUrl, duration, layout)))
+}
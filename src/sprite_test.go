@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSpriteLayoutCapsTiles(t *testing.T) {
+	layout := newSpriteLayout(7200)
+	if layout.Tiles != SPRITE_MAX_TILES || layout.Interval != 72 {
+		t.Errorf("Expected %d tiles every 72s, got %d every %f", SPRITE_MAX_TILES, layout.Tiles, layout.Interval)
+	}
+	if layout.Columns != 10 || layout.Rows != 10 {
+		t.Errorf("Expected 10x10, got %dx%d", layout.Columns, layout.Rows)
+	}
+
+	short := newSpriteLayout(5)
+	if short.Tiles != 3 || short.Columns != 3 || short.Rows != 1 {
+		t.Errorf("Expected 3 tiles in a row, got %+v", short)
+	}
+}
+
+func TestSpriteVtt(t *testing.T) {
+	vtt := SpriteVtt("/_sprite/a.mp4", 25, newSpriteLayout(25))
+	expected := "WEBVTT\n\n00:00:00.000 --> 00:00:02.000\n/_sprite/a.mp4#xywh=0,0,160,90\n"
+	if !strings.HasPrefix(vtt, expected) {
+		t.Errorf("Expected to start with %q, got %q", expected, vtt)
+	}
+	last := "00:00:24.000 --> 00:00:25.000\n/_sprite/a.mp4#xywh=320,90,160,90\n"
+	if !strings.HasSuffix(vtt, last) {
+		t.Errorf("Expected to end with %q, got %q", last, vtt)
+	}
+}
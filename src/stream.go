@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StreamTracker caps how many videos are streamed at once and keeps count
+// of what each connection has been sent
+type StreamTracker struct {
+	// Wait is how long a stream waits for a free slot before giving up,
+	// players often drop one request and make another straight away
+	Wait time.Duration
+
+	slots      chan struct{}
+	mu         sync.Mutex
+	nextId     int
+	active     map[int]*streamConnection
+	served     int
+	totalBytes atomic.Int64
+}
+
+type streamConnection struct {
+	path    string
+	started time.Time
+	bytes   atomic.Int64
+}
+
+type StreamStatus struct {
+	Path           string    `json:"path"`
+	StartedAt      time.Time `json:"startedAt"`
+	Bytes          int64     `json:"bytes"`
+	BytesPerSecond float64   `json:"bytesPerSecond"`
+}
+
+type StreamTrackerStatus struct {
+	MaxStreams int            `json:"maxStreams"`
+	Served     int            `json:"served"`
+	TotalBytes int64          `json:"totalBytes"`
+	Active     []StreamStatus `json:"active"`
+}
+
+func NewStreamTracker(maxStreams int, wait time.Duration) *StreamTracker {
+	if maxStreams < 1 {
+		maxStreams = 1
+	}
+	return &StreamTracker{
+		Wait:   wait,
+		slots:  make(chan struct{}, maxStreams),
+		active: map[int]*streamConnection{},
+	}
+}
+
+// Serve runs serve with a writer that counts what it sends, once there's
+// a slot free. If there isn't one in time the viewer is told to come back
+// later.
+func (t *StreamTracker) Serve(w http.ResponseWriter, r *http.Request, path string, serve func(w http.ResponseWriter)) {
+	if t == nil {
+		serve(w)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), t.Wait)
+	defer cancel()
+	select {
+	case t.slots <- struct{}{}:
+	case <-ctx.Done():
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Too many streams, try again shortly", http.StatusServiceUnavailable)
+		return
+	}
+	defer func() { <-t.slots }()
+
+	conn := &streamConnection{path: path, started: time.Now()}
+	t.mu.Lock()
+	id := t.nextId
+	t.nextId++
+	t.active[id] = conn
+	t.served++
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.active, id)
+		t.mu.Unlock()
+	}()
+
+	serve(&countingResponseWriter{ResponseWriter: w, conn: conn, total: &t.totalBytes})
+}
+
+func (t *StreamTracker) Status() StreamTrackerStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status := StreamTrackerStatus{
+		MaxStreams: cap(t.slots),
+		Served:     t.served,
+		TotalBytes: t.totalBytes.Load(),
+		Active:     []StreamStatus{},
+	}
+	for _, conn := range t.active {
+		bytes := conn.bytes.Load()
+		status.Active = append(status.Active, StreamStatus{
+			Path:           conn.path,
+			StartedAt:      conn.started,
+			Bytes:          bytes,
+			BytesPerSecond: float64(bytes) / time.Since(conn.started).Seconds(),
+		})
+	}
+	sort.Slice(status.Active, func(i, j int) bool {
+		return status.Active[i].StartedAt.Before(status.Active[j].StartedAt)
+	})
+	return status
+}
+
+// countingResponseWriter adds up the bytes written for a stream
+type countingResponseWriter struct {
+	http.ResponseWriter
+	conn  *streamConnection
+	total *atomic.Int64
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.conn.bytes.Add(int64(n))
+	w.total.Add(int64(n))
+	return n, err
+}
+
+// ReadFrom lets files be sent with sendfile when the underlying writer can
+func (w *countingResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(w.ResponseWriter, r)
+	w.conn.bytes.Add(n)
+	w.total.Add(n)
+	return n, err
+}
+
+// Flush sends what's been written so far, remuxed output is sent as it's
+// made
+func (w *countingResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController get at the underlying writer
+func (w *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (hdlr RequestHandlers) handleStreams(w http.ResponseWriter, r *http.Request) {
+	if hdlr.Streams == nil {
+		http.Error(w, "Stream tracking unavailable", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hdlr.Streams.Status())
+}
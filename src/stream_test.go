@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeStreamRangeFromDisk(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "clip.mp4"), []byte("0123456789"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdlr := RequestHandlers{MediaDirectory: dir, Streams: NewStreamTracker(1, time.Second)}
+
+	req := httptest.NewRequest("GET", "/_stream/clip.mp4", nil)
+	req.Header.Set("Range", "bytes=2-5")
+	rec := httptest.NewRecorder()
+	hdlr.serveStream(rec, req)
+
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "2345" {
+		t.Errorf("Expected 206 with 2345, but got %d with %q", rec.Code, rec.Body.String())
+	}
+	status := hdlr.Streams.Status()
+	if status.Served != 1 || status.TotalBytes != 4 || len(status.Active) != 0 {
+		t.Errorf("Expected one finished stream of 4 bytes, but got %+v", status)
+	}
+}
+
+func TestStreamTrackerCapsStreams(t *testing.T) {
+	tracker := NewStreamTracker(1, 10*time.Millisecond)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go tracker.Serve(httptest.NewRecorder(), httptest.NewRequest("GET", "/_stream/a.mp4", nil), "/a.mp4", func(w http.ResponseWriter) {
+		w.Write([]byte("abc"))
+		close(started)
+		<-release
+	})
+	<-started
+
+	status := tracker.Status()
+	if len(status.Active) != 1 || status.Active[0].Path != "/a.mp4" || status.Active[0].Bytes != 3 {
+		t.Errorf("Expected /a.mp4 to have sent 3 bytes, but got %+v", status.Active)
+	}
+
+	rec := httptest.NewRecorder()
+	tracker.Serve(rec, httptest.NewRequest("GET", "/_stream/b.mp4", nil), "/b.mp4", func(w http.ResponseWriter) {
+		t.Errorf("Expected the second stream to wait for a slot")
+	})
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 503 with Retry-After, but got %d", rec.Code)
+	}
+	close(release)
+}
+
+func TestCountingResponseWriterKeepsOptionalInterfaces(t *testing.T) {
+	tracker := NewStreamTracker(1, time.Second)
+	rec := httptest.NewRecorder()
+	tracker.Serve(rec, httptest.NewRequest("GET", "/_stream/a.mp4", nil), "/a.mp4", func(w http.ResponseWriter) {
+		readerFrom, ok := w.(io.ReaderFrom)
+		if !ok {
+			t.Fatal("Expected the writer to keep ReadFrom for sendfile")
+		}
+		readerFrom.ReadFrom(strings.NewReader("abcdef"))
+		if _, ok := w.(http.Flusher); !ok {
+			t.Errorf("Expected the writer to keep Flush")
+		}
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Errorf("Expected a response controller to flush, but got %v", err)
+		}
+	})
+	if rec.Body.String() != "abcdef" || !rec.Flushed || tracker.Status().TotalBytes != 6 {
+		t.Errorf("Expected 6 flushed bytes to be counted, but got %q and %+v", rec.Body.String(), tracker.Status())
+	}
+}
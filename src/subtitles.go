@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+	"golang.org/x/text/language"
+	"golang.org/x/text/language/display"
+)
+
+// SubtitleTrack is a text track for the content viewer's player
+type SubtitleTrack struct {
+	Label    string
+	Language string
+	URL      string
+}
+
+var (
+	subtitleExtensions = []string{"srt", "vtt", "ass", "ssa"}
+	// Embedded subtitles ffmpeg can turn into WebVTT, picture based ones
+	// like PGS and VobSub would need OCR
+	textSubtitleCodecs = []string{"subrip", "ass", "ssa", "webvtt", "mov_text", "text"}
+)
+
+// subtitlesVersion is part of the cache keys for converted subtitles
+const subtitlesVersion = 1
+
+// subtitleSource is somewhere subtitles for a video come from, either a
+// sidecar file next to it or a stream inside it
+type subtitleSource struct {
+	path     string
+	stream   int
+	language string
+	title    string
+}
+
+func (source subtitleSource) isSidecar() bool {
+	return source.stream < 0
+}
+
+// sidecarSubtitles finds subtitle files named after the video, like
+// movie.srt or movie.en.forced.srt for movie.mkv
+func sidecarSubtitles(videoPath string) []subtitleSource {
+	dir := filepath.Dir(videoPath)
+	stem := strings.TrimSuffix(filepath.Base(videoPath), filepath.Ext(videoPath))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return []subtitleSource{}
+	}
+	sources := []subtitleSource{}
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if entry.IsDir() || !strings.HasPrefix(name, stem+".") || !slices.Contains(subtitleExtensions, strings.ToLower(strings.TrimPrefix(ext, "."))) {
+			continue
+		}
+		source := subtitleSource{path: filepath.Join(dir, name), stream: -1}
+		middle := strings.Trim(strings.TrimSuffix(strings.TrimPrefix(name, stem), ext), ".")
+		if middle != "" {
+			parts := strings.Split(middle, ".")
+			source.language = parts[0]
+			source.title = strings.Join(parts[1:], " ")
+		}
+		sources = append(sources, source)
+	}
+	return sources
+}
+
+// embeddedSubtitles lists the text subtitle streams in a video
+func embeddedSubtitles(videoPath string, probe FFMpegProbe) []subtitleSource {
+	sources := []subtitleSource{}
+	for _, stream := range probe.Streams {
+		if stream.CodecType != "subtitle" || !slices.Contains(textSubtitleCodecs, stream.CodecName) {
+			continue
+		}
+		sources = append(sources, subtitleSource{
+			path:     videoPath,
+			stream:   stream.Index,
+			language: stream.Tags.Language,
+			title:    stream.Tags.Title,
+		})
+	}
+	return sources
+}
+
+func findSubtitles(videoPath string, probe FFMpegProbe) []subtitleSource {
+	return append(sidecarSubtitles(videoPath), embeddedSubtitles(videoPath, probe)...)
+}
+
+// languageTag makes sense of the language codes in file names and stream
+// tags, which are a mix of en, eng and en-GB
+func languageTag(code string) (language.Tag, bool) {
+	if code == "" || code == "und" {
+		return language.Und, false
+	}
+	tag, err := language.Parse(code)
+	if err != nil {
+		return language.Und, false
+	}
+	return tag, true
+}
+
+// subtitleTracks describes the subtitles for a video for the player, each
+// named after its language where we know it
+func subtitleTracks(mediaPath string, videoPath string, probe FFMpegProbe) []SubtitleTrack {
+	tracks := []SubtitleTrack{}
+	for i, source := range findSubtitles(videoPath, probe) {
+		query := url.Values{}
+		if source.isSidecar() {
+			query.Set("file", filepath.Base(source.path))
+		} else {
+			query.Set("stream", strconv.Itoa(source.stream))
+		}
+		track := SubtitleTrack{
+			URL: (&url.URL{Path: "/_subtitles" + mediaPath, RawQuery: query.Encode()}).String(),
+		}
+		labels := []string{}
+		if tag, ok := languageTag(source.language); ok {
+			base, _ := tag.Base()
+			track.Language = base.String()
+			labels = append(labels, display.English.Tags().Name(tag))
+		}
+		if source.title != "" {
+			labels = append(labels, source.title)
+		}
+		if len(labels) == 0 {
+			labels = append(labels, fmt.Sprintf("Subtitles %d", i+1))
+		}
+		track.Label = strings.Join(labels, " - ")
+		tracks = append(tracks, track)
+	}
+	return tracks
+}
+
+var srtTimestamp = regexp.MustCompile(`(\d+:\d{2}:\d{2}),(\d{3})`)
+
+// srtToVtt converts SubRip to WebVTT, which is mostly a matter of the
+// header and using dots in timestamps
+func srtToVtt(srt []byte) []byte {
+	text := strings.ReplaceAll(string(bytes.TrimPrefix(srt, []byte("\ufeff"))), "\r\n", "\n")
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if strings.Contains(line, "-->") {
+			lines[i] = srtTimestamp.ReplaceAllString(line, "$1.$2")
+		}
+	}
+	return []byte("WEBVTT\n\n" + strings.Join(lines, "\n"))
+}
+
+// ReadSubtitlesAsVtt has ffmpeg convert a subtitle file, or a subtitle
+// stream in a video, to WebVTT
+func ReadSubtitlesAsVtt(source subtitleSource) ([]byte, error) {
+	stream := "0:s:0"
+	if !source.isSidecar() {
+		stream = fmt.Sprintf("0:%d", source.stream)
+	}
+	buf := bytes.NewBuffer(nil)
+	err := ffmpeg.Input(source.path).
+		Output("pipe:", ffmpeg.KwArgs{"map": stream, "f": "webvtt"}).
+		WithOutput(buf).
+		Run()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// LoadSubtitles returns subtitles as WebVTT. SubRip and WebVTT files are
+// quick to handle here, everything else goes through ffmpeg and is cached
+// as pulling a stream out of a video means reading all of it.
+func (t *Thumbnailer) LoadSubtitles(ctx context.Context, source subtitleSource) ([]byte, error) {
+	if source.isSidecar() {
+		switch strings.ToLower(filepath.Ext(source.path)) {
+		case ".vtt":
+			return os.ReadFile(source.path)
+		case ".srt":
+			srt, err := os.ReadFile(source.path)
+			if err != nil {
+				return nil, err
+			}
+			return srtToVtt(srt), nil
+		}
+	}
+	info, err := os.Stat(source.path)
+	if err != nil {
+		return nil, err
+	}
+	variant := fmt.Sprintf("subtitles-v%d-%d", subtitlesVersion, source.stream)
+	return t.inFlight.loadDerived(ctx, t.Cache, t.videos, source.path, info, variant, func() ([]byte, error) {
+		return ReadSubtitlesAsVtt(source)
+	})
+}
+
+func (hdlr RequestHandlers) getSubtitles(w http.ResponseWriter, r *http.Request) {
+	videoPath := strings.Replace(r.URL.Path, "/_subtitles", hdlr.MediaDirectory, 1)
+	st, err := os.Stat(videoPath)
+	if err != nil {
+		http.Error(w, "No file found", http.StatusNotFound)
+		return
+	}
+	prts := strings.Split(videoPath, ".")
+	if !slices.Contains(videoExtensions, strings.ToLower(prts[len(prts)-1])) {
+		http.Error(w, "Not a video", http.StatusBadRequest)
+		return
+	}
+
+	// only subtitles we found ourselves are served, so the query can't
+	// point anywhere else
+	var sources []subtitleSource
+	query := r.URL.Query()
+	if query.Has("stream") {
+		probe, err := readCachedProbe(videoPath, st)
+		if err != nil {
+			http.Error(w, "Error reading video", http.StatusInternalServerError)
+			return
+		}
+		sources = embeddedSubtitles(videoPath, probe)
+	} else {
+		sources = sidecarSubtitles(videoPath)
+	}
+	index := slices.IndexFunc(sources, func(source subtitleSource) bool {
+		if source.isSidecar() {
+			return filepath.Base(source.path) == query.Get("file")
+		}
+		return query.Get("stream") == strconv.Itoa(source.stream)
+	})
+	if index < 0 {
+		http.Error(w, "No such subtitles", http.StatusNotFound)
+		return
+	}
+
+	// a sidecar can be edited without touching the video
+	sourceSt, err := os.Stat(sources[index].path)
+	if err != nil {
+		http.Error(w, "No such subtitles", http.StatusNotFound)
+		return
+	}
+	byts, err := hdlr.Thumbnailer.LoadSubtitles(r.Context(), sources[index])
+	if err != nil {
+		fmt.Println("Error converting subtitles:", err)
+		http.Error(w, "Error converting subtitles", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	http.ServeContent(w, r, sourceSt.Name(), sourceSt.ModTime(), bytes.NewReader(byts))
+}
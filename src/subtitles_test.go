@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSubtitleTracks(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"movie.mkv", "movie.srt", "movie.fr.forced.vtt", "movie.nfo", "movie2.en.srt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	probe := FFMpegProbe{Streams: []FFMPegStreamFormat{
+		{Index: 0, CodecType: "video", CodecName: "h264"},
+		{Index: 2, CodecType: "subtitle", CodecName: "subrip", Tags: FFMPegStreamTags{Language: "ger", Title: "SDH"}},
+		{Index: 3, CodecType: "subtitle", CodecName: "hdmv_pgs_subtitle", Tags: FFMPegStreamTags{Language: "eng"}},
+	}}
+	tracks := subtitleTracks("/films/movie.mkv", filepath.Join(dir, "movie.mkv"), probe)
+	expected := []SubtitleTrack{
+		{Label: "French - forced", Language: "fr", URL: "/_subtitles/films/movie.mkv?file=movie.fr.forced.vtt"},
+		{Label: "Subtitles 2", URL: "/_subtitles/films/movie.mkv?file=movie.srt"},
+		{Label: "German - SDH", Language: "de", URL: "/_subtitles/films/movie.mkv?stream=2"},
+	}
+	if len(tracks) != len(expected) {
+		t.Fatalf("Expected %+v, but got %+v", expected, tracks)
+	}
+	for i := range expected {
+		if tracks[i] != expected[i] {
+			t.Errorf("Expected %+v, but got %+v", expected[i], tracks[i])
+		}
+	}
+}
+
+func TestSrtToVtt(t *testing.T) {
+	srt := "\ufeff1\r\n00:00:01,500 --> 00:00:03,250\r\nHello, world\r\n"
+	expected := "WEBVTT\n\n1\n00:00:01.500 --> 00:00:03.250\nHello, world\n"
+	if vtt := string(srtToVtt([]byte(srt))); vtt != expected {
+		t.Errorf("Expected %q, but got %q", expected, vtt)
+	}
+}
+
+func TestGetSubtitlesOnlyServesSidecars(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "movie.mp4"), []byte{}, 0644)
+	os.WriteFile(filepath.Join(dir, "movie.en.srt"), []byte("1\n00:00:01,000 --> 00:00:02,000\nHi\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "secret.srt"), []byte("1\n00:00:01,000 --> 00:00:02,000\nNo\n"), 0644)
+	edited := time.Now().Add(time.Hour).Truncate(time.Second)
+	os.Chtimes(filepath.Join(dir, "movie.en.srt"), edited, edited)
+	hdlr := RequestHandlers{MediaDirectory: dir, Thumbnailer: NewThumbnailer(nil, 1, 1, 0)}
+
+	rec := httptest.NewRecorder()
+	hdlr.getSubtitles(rec, httptest.NewRequest("GET", "/_subtitles/movie.mp4?file=movie.en.srt", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/vtt; charset=utf-8" {
+		t.Errorf("Expected vtt subtitles, but got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	// the subtitles changed after the video did
+	if rec.Header().Get("Last-Modified") != edited.UTC().Format(http.TimeFormat) {
+		t.Errorf("Expected %s, but got %s", edited.UTC().Format(http.TimeFormat), rec.Header().Get("Last-Modified"))
+	}
+
+	rec = httptest.NewRecorder()
+	hdlr.getSubtitles(rec, httptest.NewRequest("GET", "/_subtitles/movie.mp4?file=secret.srt", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected %d, but got %d", http.StatusNotFound, rec.Code)
+	}
+}
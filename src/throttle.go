@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"sync"
+)
+
+// flightGroup shares the result of a call between everyone asking for the
+// same key while it is still in progress
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	val  []byte
+	err  error
+}
+
+// Do runs fn once per key at a time. The work carries on if ctx finishes
+// first, so whoever asks next (or the cache) still gets the result.
+func (g *flightGroup) Do(ctx context.Context, key string, fn func() ([]byte, error)) ([]byte, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*flightCall{}
+	}
+	call, ok := g.calls[key]
+	if !ok {
+		call = &flightCall{done: make(chan struct{})}
+		g.calls[key] = call
+		go func() {
+			call.val, call.err = fn()
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+			close(call.done)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.val, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// loadDerived returns something made from the file at path from the
+// cache, or generates it under limiter and caches it as variant. Anyone
+// asking for the same thing meanwhile waits on the same generate.
+func (g *flightGroup) loadDerived(ctx context.Context, cache *DiskCache, limiter workLimiter, path string, info fs.FileInfo, variant string, generate func() ([]byte, error)) ([]byte, error) {
+	key := derivedCacheKey(path, info, variant)
+	if byts, ok := cache.Get(key); ok {
+		return byts, nil
+	}
+	return g.Do(ctx, key, func() ([]byte, error) {
+		return limiter.Run(func() ([]byte, error) {
+			// someone may have finished it while we were queued
+			if byts, ok := cache.Get(key); ok {
+				return byts, nil
+			}
+			byts, err := generate()
+			if err != nil {
+				return nil, err
+			}
+			err = cache.putDerived(path, info, variant, byts)
+			if err != nil {
+				fmt.Printf("Error caching %s: %s\n", variant, err)
+			}
+			return byts, nil
+		})
+	})
+}
+
+// workLimiter bounds how many expensive jobs run at once, anything over
+// the limit queues until a slot frees up
+type workLimiter chan struct{}
+
+func newWorkLimiter(size int) workLimiter {
+	if size < 1 {
+		size = 1
+	}
+	return make(workLimiter, size)
+}
+
+func (l workLimiter) Run(fn func() ([]byte, error)) ([]byte, error) {
+	l <- struct{}{}
+	defer func() { <-l }()
+	return fn()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupSharesInProgressWork(t *testing.T) {
+	var group flightGroup
+	var calls int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			byts, err := group.Do(context.Background(), "key", func() ([]byte, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return []byte("thumbnail"), nil
+			})
+			if err != nil || string(byts) != "thumbnail" {
+				t.Errorf("Expected thumbnail, got %s %v", byts, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("Expected 1 call, got %d", calls)
+	}
+}
+
+func TestFlightGroupGivesUpOnContext(t *testing.T) {
+	var group flightGroup
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	release := make(chan struct{})
+	defer close(release)
+	_, err := group.Do(ctx, "key", func() ([]byte, error) {
+		<-release
+		return nil, nil
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+}
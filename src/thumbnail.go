@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/fs"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
+)
+
+// decodeImage turns the contents of any of the imageExtensions into an
+// image, rasterizing svgs big enough to cover the requested size
+func decodeImage(fileContents []byte, width uint, height uint) (image.Image, error) {
+	mtype := mimetype.Detect(fileContents)
+	if !strings.HasPrefix(mtype.String(), "image/") {
+		return nil, fmt.Errorf("not recognised as image: %s", mtype.String())
+	}
+
+	imgFormat := strings.Split(mtype.String(), "/")[1]
+
+	switch imgFormat {
+	case "jpeg":
+		return jpeg.Decode(bytes.NewReader(fileContents))
+	case "bmp":
+		return bmp.Decode(bytes.NewReader(fileContents))
+	case "png":
+		return png.Decode(bytes.NewReader(fileContents))
+	case "gif":
+		return gif.Decode(bytes.NewReader(fileContents))
+	case "tiff":
+		return tiff.Decode(bytes.NewReader(fileContents))
+	case "webp":
+		return webp.Decode(bytes.NewReader(fileContents))
+	case "svg+xml":
+		return rasterizeSvg(fileContents, width, height)
+	default:
+		return nil, fmt.Errorf("unsupported image format: %s", mtype.String())
+	}
+}
+
+func rasterizeSvg(fileContents []byte, width uint, height uint) (image.Image, error) {
+	icon, err := oksvg.ReadIconStream(bytes.NewReader(fileContents), oksvg.IgnoreErrorMode)
+	if err != nil {
+		return nil, err
+	}
+	viewWidth, viewHeight := icon.ViewBox.W, icon.ViewBox.H
+	if viewWidth <= 0 || viewHeight <= 0 {
+		return nil, fmt.Errorf("svg has no usable viewBox")
+	}
+	scale := math.Max(float64(width)/viewWidth, float64(height)/viewHeight)
+	rasterWidth := int(math.Round(viewWidth * scale))
+	rasterHeight := int(math.Round(viewHeight * scale))
+	if rasterWidth == 0 || rasterHeight == 0 {
+		return nil, fmt.Errorf("svg too small to rasterize at %dx%d", width, height)
+	}
+	icon.SetTarget(0, 0, float64(rasterWidth), float64(rasterHeight))
+	img := image.NewRGBA(image.Rect(0, 0, rasterWidth, rasterHeight))
+	scanner := rasterx.NewScannerGV(rasterWidth, rasterHeight, img, img.Bounds())
+	icon.Draw(rasterx.NewDasher(rasterWidth, rasterHeight, scanner), 1)
+	return img, nil
+}
+
+// thumbnailOptions are everything about a thumbnail that can be asked for
+type thumbnailOptions struct {
+	width, height uint
+	fit, gravity  string
+	format        string
+	quality       int
+}
+
+func ReadImageThumbnail(fileContents []byte, opts thumbnailOptions) ([]byte, error) {
+	img, err := fitThumbnailImage(fileContents, opts)
+	if err != nil {
+		return nil, err
+	}
+	return encodeThumbnail(img, opts.format, opts.quality)
+}
+
+// fitThumbnailImage decodes an image the right way up and fits it to the
+// thumbnail's size, ready to be encoded
+func fitThumbnailImage(fileContents []byte, opts thumbnailOptions) (image.Image, error) {
+	img, err := decodeImage(fileContents, opts.width, opts.height)
+	if err != nil {
+		return nil, err
+	}
+	if mimetype.Detect(fileContents).String() != "image/svg+xml" {
+		img = applyOrientation(img, exifOrientation(fileContents))
+	}
+	return fitImage(img, opts.width, opts.height, opts.fit, opts.gravity), nil
+}
+
+// encodedWithFfmpeg is whether a thumbnail format needs an ffmpeg process
+func encodedWithFfmpeg(format string) bool {
+	return format == "webp" || format == "avif"
+}
+
+var (
+	DEFAULT_THUMBNAIL_WIDTH   = 320
+	DEFAULT_THUMBNAIL_QUALITY = 80
+	// MAX_THUMBNAIL_DIMENSION stops anyone asking for height=100000
+	MAX_THUMBNAIL_DIMENSION = 2048
+)
+
+// thumbnailWidths is the ladder of widths thumbnails come in, anything
+// else is rounded up to the next one so the cache isn't full of widths
+// that are a pixel apart
+var thumbnailWidths = []uint{160, 320, 640, 960, 1280, 1920}
+
+// galleryThumbnailWidths are offered to the browser in the gallery's
+// srcset, so are the ones worth generating ahead of time
+var galleryThumbnailWidths = []uint{320, 640, 960}
+
+// GALLERY_THUMBNAIL_ASPECT is the width over height of gallery tiles, their
+// thumbnails are cropped to it so the grid lines up
+var GALLERY_THUMBNAIL_ASPECT = 4.0 / 3.0
+
+// galleryThumbnailOptions is the thumbnail a gallery tile asks for at a width
+func galleryThumbnailOptions(width uint) thumbnailOptions {
+	return thumbnailOptions{
+		width:   width,
+		height:  uint(math.Round(float64(width) / GALLERY_THUMBNAIL_ASPECT)),
+		fit:     "cover",
+		gravity: thumbnailGravities[0],
+		quality: DEFAULT_THUMBNAIL_QUALITY,
+	}
+}
+
+// query asks for these options in a thumbnail url, the format is left to
+// the browser to negotiate
+func (opts thumbnailOptions) query() url.Values {
+	values := url.Values{"width": {fmt.Sprint(opts.width)}}
+	if opts.height != 0 {
+		values.Set("height", fmt.Sprint(opts.height))
+	}
+	if opts.fit != thumbnailFits[0] {
+		values.Set("fit", opts.fit)
+	}
+	if opts.gravity != thumbnailGravities[0] {
+		values.Set("gravity", opts.gravity)
+	}
+	return values
+}
+
+func snapThumbnailWidth(width uint) uint {
+	for _, allowed := range thumbnailWidths {
+		if width <= allowed {
+			return allowed
+		}
+	}
+	return thumbnailWidths[len(thumbnailWidths)-1]
+}
+
+// parseThumbnailOptions reads the thumbnail query parameters, falling back
+// to defaults for anything missing or nonsensical
+func parseThumbnailOptions(r *http.Request) thumbnailOptions {
+	query := r.URL.Query()
+	dimension := func(name string) uint {
+		value, err := strconv.Atoi(query.Get(name))
+		if err != nil || value < 1 {
+			return 0
+		}
+		return uint(math.Min(float64(value), float64(MAX_THUMBNAIL_DIMENSION)))
+	}
+	opts := thumbnailOptions{
+		width:   dimension("width"),
+		height:  dimension("height"),
+		fit:     query.Get("fit"),
+		gravity: query.Get("gravity"),
+		format:  negotiateThumbnailFormat(r),
+	}
+	if opts.width == 0 && opts.height == 0 {
+		opts.width = uint(DEFAULT_THUMBNAIL_WIDTH)
+	}
+	if opts.width != 0 {
+		snapped := snapThumbnailWidth(opts.width)
+		if opts.height != 0 {
+			// keep the shape that was asked for
+			height := math.Round(float64(opts.height) * float64(snapped) / float64(opts.width))
+			opts.height = uint(math.Min(math.Max(height, 1), float64(MAX_THUMBNAIL_DIMENSION)))
+		}
+		opts.width = snapped
+	}
+	if !slices.Contains(thumbnailFits, opts.fit) {
+		opts.fit = thumbnailFits[0]
+	}
+	if !slices.Contains(thumbnailGravities, opts.gravity) {
+		opts.gravity = thumbnailGravities[0]
+	}
+	quality, err := strconv.Atoi(query.Get("quality"))
+	if err != nil || quality < 1 || quality > 100 {
+		quality = DEFAULT_THUMBNAIL_QUALITY
+	}
+	opts.quality = quality
+	return opts
+}
+
+// thumbnailFormats maps what can be asked for with format= to the
+// format we encode
+var thumbnailFormats = map[string]string{
+	"jpeg": "jpeg",
+	"jpg":  "jpeg",
+	"png":  "png",
+	"webp": "webp",
+	"avif": "avif",
+}
+
+// negotiateThumbnailFormat picks the thumbnail format from the format=
+// override, or failing that the best the Accept header allows
+func negotiateThumbnailFormat(r *http.Request) string {
+	if format, ok := thumbnailFormats[strings.ToLower(r.URL.Query().Get("format"))]; ok {
+		return format
+	}
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		refused := false
+		for _, param := range params[1:] {
+			q, found := strings.CutPrefix(strings.TrimSpace(param), "q=")
+			if found {
+				weight, err := strconv.ParseFloat(q, 64)
+				refused = err == nil && weight == 0
+			}
+		}
+		accepted[mediaType] = !refused
+	}
+	// webp first as it's far quicker to encode than avif
+	if accepted["image/webp"] {
+		return "webp"
+	}
+	if accepted["image/avif"] {
+		return "avif"
+	}
+	return "jpeg"
+}
+
+func encodeThumbnail(img image.Image, format string, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	switch format {
+	case "png":
+		err := png.Encode(&buf, img)
+		return buf.Bytes(), err
+	case "webp", "avif":
+		byts, err := encodeWithFfmpeg(img, format, quality)
+		if err == nil {
+			return byts, nil
+		}
+		// this ffmpeg might not have the encoder, jpeg will do
+		fmt.Printf("Error encoding %s thumbnail: %s\n", format, err)
+	}
+	if !isOpaque(img) {
+		// jpeg has no transparency, so put it on a white background
+		flat := image.NewRGBA(img.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+		img = flat
+	}
+	err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	return buf.Bytes(), err
+}
+
+func isOpaque(img image.Image) bool {
+	opaque, ok := img.(interface{ Opaque() bool })
+	return !ok || opaque.Opaque()
+}
+
+// encodeWithFfmpeg handles the formats go can't encode itself
+func encodeWithFfmpeg(img image.Image, format string, quality int) ([]byte, error) {
+	var input bytes.Buffer
+	err := png.Encode(&input, img)
+	if err != nil {
+		return nil, err
+	}
+	// the avif muxer needs to seek, so go via a file rather than a pipe
+	out, err := os.CreateTemp("", "smg-thumbnail-*."+format)
+	if err != nil {
+		return nil, err
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	args := ffmpeg.KwArgs{"frames:v": 1, "f": format}
+	switch format {
+	case "webp":
+		args["c:v"] = "libwebp"
+		args["quality"] = quality
+	case "avif":
+		args["c:v"] = "libaom-av1"
+		args["still-picture"] = 1
+		args["cpu-used"] = 6
+		args["crf"] = 63 - quality*63/100
+	}
+	err = ffmpeg.Input("pipe:", ffmpeg.KwArgs{"f": "png_pipe"}).
+		Output(out.Name(), args).
+		OverWriteOutput().
+		WithInput(&input).
+		Run()
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(out.Name())
+}
+
+// thumbnailVersion is bumped whenever the way images are processed
+// changes, so thumbnails from before then aren't served from the cache
+const thumbnailVersion = 3
+
+// thumbnailRequest describes a single thumbnail that can be generated,
+// whether that's from an http request or ahead of time
+type thumbnailRequest struct {
+	thumbnailOptions
+	path    string
+	info    fs.FileInfo
+	isVideo bool
+	// poster is a sidecar image to use instead of a frame from the video
+	poster     string
+	posterInfo fs.FileInfo
+}
+
+func newThumbnailRequest(path string, info fs.FileInfo, isVideo bool, opts thumbnailOptions) thumbnailRequest {
+	req := thumbnailRequest{
+		thumbnailOptions: opts,
+		path:             path,
+		info:             info,
+		isVideo:          isVideo,
+	}
+	if isVideo {
+		req.poster, req.posterInfo = posterSidecar(path)
+	}
+	return req
+}
+
+func (req thumbnailRequest) variant() string {
+	variant := fmt.Sprintf("w%d-h%d-%s-%s-%s-q%d-v%d",
+		req.width, req.height, req.fit, req.gravity, req.format, req.quality, thumbnailVersion)
+	if req.poster != "" {
+		// a new or changed poster needs a new thumbnail
+		variant += fmt.Sprintf("-%s-%d", req.poster, req.posterInfo.ModTime().UnixNano())
+	}
+	return variant
+}
+
+func (req thumbnailRequest) cacheKey() string {
+	return derivedCacheKey(req.path, req.info, req.variant())
+}
+
+// Thumbnailer generates thumbnails through the cache, sharing work between
+// identical requests and keeping a lid on how much decoding and ffmpeg
+// happens at once
+type Thumbnailer struct {
+	Cache *DiskCache
+	// Timeout is how long a request waits before giving up on a thumbnail,
+	// generation carries on in the background regardless
+	Timeout time.Duration
+
+	images workLimiter
+	// videos limits the ffmpeg processes, grabbing frames from videos and
+	// encoding webp and avif
+	videos   workLimiter
+	inFlight flightGroup
+}
+
+func NewThumbnailer(cache *DiskCache, imageConcurrency int, videoConcurrency int, timeout time.Duration) *Thumbnailer {
+	return &Thumbnailer{
+		Cache:   cache,
+		Timeout: timeout,
+		images:  newWorkLimiter(imageConcurrency),
+		videos:  newWorkLimiter(videoConcurrency),
+	}
+}
+
+// Load returns the thumbnail from the cache, generating and caching it if
+// it isn't there yet
+func (t *Thumbnailer) Load(ctx context.Context, req thumbnailRequest) ([]byte, error) {
+	key := req.cacheKey()
+	if byts, ok := t.Cache.Get(key); ok {
+		return byts, nil
+	}
+	return t.inFlight.Do(ctx, key, func() ([]byte, error) {
+		source, err := t.source(req)
+		if err != nil {
+			return nil, err
+		}
+		var img image.Image
+		cached, err := t.images.Run(func() ([]byte, error) {
+			// someone may have finished it while we were queued
+			if byts, ok := t.Cache.Get(key); ok {
+				return byts, nil
+			}
+			var err error
+			img, err = fitThumbnailImage(source, req.thumbnailOptions)
+			return nil, err
+		})
+		if err != nil || cached != nil {
+			return cached, err
+		}
+		// webp and avif go through ffmpeg, so they share its budget
+		encoders := t.images
+		if encodedWithFfmpeg(req.format) {
+			encoders = t.videos
+		}
+		byts, err := encoders.Run(func() ([]byte, error) {
+			return encodeThumbnail(img, req.format, req.quality)
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = t.Cache.putDerived(req.path, req.info, req.variant(), byts)
+		if err != nil {
+			fmt.Println("Error caching thumbnail:", err)
+		}
+		return byts, nil
+	})
+}
+
+// source is the image a thumbnail is made from, for videos that's their
+// poster or a frame which is cached so every size and format doesn't need
+// ffmpeg again
+func (t *Thumbnailer) source(req thumbnailRequest) ([]byte, error) {
+	if !req.isVideo {
+		return os.ReadFile(req.path)
+	}
+	if req.poster != "" {
+		return os.ReadFile(req.poster)
+	}
+	return t.inFlight.loadDerived(context.Background(), t.Cache, t.videos, req.path, req.info, frameVariant, func() ([]byte, error) {
+		return ReadPreviewFrameAsJpeg(req.path)
+	})
+}
+
+// requestContext is the request's context, cut short after Timeout so a
+// stuck ffmpeg doesn't hold the request open
+func (t *Thumbnailer) requestContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if t.Timeout > 0 {
+		return context.WithTimeout(r.Context(), t.Timeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
+func (hdlr RequestHandlers) getThumbnail(w http.ResponseWriter, r *http.Request) {
+	filepath := r.URL.Path
+	filepath = strings.Replace(filepath, "/_thumbnail", hdlr.MediaDirectory, 1)
+	st, err := os.Stat(filepath)
+	if err != nil {
+		http.Error(w, "No file found", http.StatusNotFound)
+		return
+	}
+	prts := strings.Split(filepath, ".")
+	ext := strings.ToLower(prts[len(prts)-1])
+	isImage := slices.Contains(imageExtensions, ext)
+	isVideo := slices.Contains(videoExtensions, ext)
+	if !isImage && !isVideo {
+		hdlr.serveFallbackThumbnail(w, r, "./static/picture.png")
+		return
+	}
+
+	ctx, cancel := hdlr.Thumbnailer.requestContext(r)
+	defer cancel()
+	byts, err := hdlr.Thumbnailer.Load(ctx, newThumbnailRequest(filepath, st, isVideo, parseThumbnailOptions(r)))
+	if err != nil {
+		fmt.Println("Error generating thumbnail:", err)
+		// don't let the browser hang on to the placeholder
+		w.Header().Set("Cache-Control", "no-store")
+		if isVideo {
+			hdlr.serveFallbackThumbnail(w, r, "./static/play.png")
+		} else {
+			hdlr.serveFallbackThumbnail(w, r, "./static/picture.png")
+		}
+		return
+	}
+	// the thumbnail isn't necessarily the same format as the original
+	w.Header().Set("Content-Type", mimetype.Detect(byts).String())
+	w.Header().Set("Vary", "Accept")
+	http.ServeContent(w, r, st.Name(), st.ModTime(), bytes.NewReader(byts))
+}
+
+func (hdlr RequestHandlers) serveFallbackThumbnail(w http.ResponseWriter, r *http.Request, fallback string) {
+	file, err := os.Open(fallback)
+	if err != nil {
+		http.Error(w, "No file found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	hdlr.serveFile(w, r, file)
+}
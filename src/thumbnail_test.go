@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gabriel-vasile/mimetype"
+	"golang.org/x/image/tiff"
+)
+
+func TestReadImageThumbnailHandlesTiff(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	src.Set(1, 1, color.RGBA{255, 0, 0, 255})
+	var buf bytes.Buffer
+	if err := tiff.Encode(&buf, src, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	byts, err := ReadImageThumbnail(buf.Bytes(), thumbnailOptions{width: 10, format: "jpeg", quality: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mtype := mimetype.Detect(byts).String(); mtype != "image/jpeg" {
+		t.Errorf("Expected image/jpeg, got %s", mtype)
+	}
+	img, _, err := image.Decode(bytes.NewReader(byts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 10 || img.Bounds().Dy() != 5 {
+		t.Errorf("Expected 10x5, got %v", img.Bounds())
+	}
+}
+
+func TestReadImageThumbnailRasterizesSvg(t *testing.T) {
+	svg := `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 100 50"><rect width="100" height="50" fill="#f00"/></svg>`
+
+	byts, err := ReadImageThumbnail([]byte(svg), thumbnailOptions{width: 60, format: "png", quality: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mtype := mimetype.Detect(byts).String(); mtype != "image/png" {
+		t.Errorf("Expected image/png, got %s", mtype)
+	}
+	img, _, err := image.Decode(bytes.NewReader(byts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 60 || img.Bounds().Dy() != 30 {
+		t.Errorf("Expected 60x30, got %v", img.Bounds())
+	}
+}
+
+func TestApplyOrientationRotatesClockwise(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	red := color.RGBA{255, 0, 0, 255}
+	src.Set(0, 0, red)
+
+	rotated := applyOrientation(src, 6)
+
+	if rotated.Bounds().Dx() != 2 || rotated.Bounds().Dy() != 3 {
+		t.Fatalf("Expected 2x3, got %v", rotated.Bounds())
+	}
+	if rotated.At(1, 0) != red {
+		t.Errorf("Expected top left to end up top right, got %v", rotated.At(1, 0))
+	}
+}
+
+func TestNegotiateThumbnailFormat(t *testing.T) {
+	cases := []struct {
+		url, accept, expected string
+	}{
+		{"/_thumbnail/a.png", "image/avif,image/webp,image/apng,*/*;q=0.8", "webp"},
+		{"/_thumbnail/a.png", "image/avif,*/*;q=0.8", "avif"},
+		{"/_thumbnail/a.png", "image/webp;q=0,*/*", "jpeg"},
+		{"/_thumbnail/a.png", "", "jpeg"},
+		{"/_thumbnail/a.png?format=png", "image/webp", "png"},
+		{"/_thumbnail/a.png?format=jpg", "image/webp", "jpeg"},
+		{"/_thumbnail/a.png?format=nonsense", "image/webp", "webp"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.url, nil)
+		r.Header.Set("Accept", c.accept)
+		if format := negotiateThumbnailFormat(r); format != c.expected {
+			t.Errorf("%s with Accept %q: expected %s, got %s", c.url, c.accept, c.expected, format)
+		}
+	}
+}
+
+func TestFitImage(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	cases := []struct {
+		width, height uint
+		fit, gravity  string
+		expected      image.Point
+	}{
+		{100, 0, "contain", "center", image.Pt(100, 50)},
+		{0, 100, "contain", "center", image.Pt(200, 100)},
+		{100, 100, "contain", "center", image.Pt(100, 50)},
+		{100, 100, "cover", "center", image.Pt(100, 100)},
+		{100, 100, "cover", "entropy", image.Pt(100, 100)},
+		{100, 100, "cover", "attention", image.Pt(100, 100)},
+		{100, 100, "fill", "center", image.Pt(100, 100)},
+	}
+	for _, c := range cases {
+		fitted := fitImage(src, c.width, c.height, c.fit, c.gravity)
+		if fitted.Bounds().Size() != c.expected {
+			t.Errorf("%dx%d %s %s: expected %v, got %v", c.width, c.height, c.fit, c.gravity, c.expected, fitted.Bounds().Size())
+		}
+	}
+}
+
+func TestFitImageCoversFromACrop(t *testing.T) {
+	// a banner scaled up to cover the box first would be 200000 pixels wide
+	src := image.NewRGBA(image.Rect(0, 0, 10000, 10))
+	for y := 0; y < 10; y++ {
+		src.Set(9999, y, color.White)
+	}
+	fitted := fitImage(src, 200, 200, "cover", "right")
+	if fitted.Bounds().Size() != image.Pt(200, 200) {
+		t.Errorf("Expected 200x200, got %v", fitted.Bounds().Size())
+	}
+	if r, _, _, _ := fitted.At(fitted.Bounds().Max.X-1, fitted.Bounds().Min.Y).RGBA(); r == 0 {
+		t.Errorf("Expected the crop to come from the right hand end")
+	}
+}
+
+func TestCropWindowFindsTheDetail(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 300, 100))
+	// all the interest is on the right hand side
+	for y := 0; y < 100; y++ {
+		for x := 200; x < 300; x++ {
+			if (x+y)%2 == 0 {
+				src.Set(x, y, color.White)
+			}
+		}
+	}
+	rect := cropWindow(src, 100, 100, "entropy")
+	if rect.Min.X != 200 {
+		t.Errorf("Expected crop from the right, got %v", rect)
+	}
+}
+
+func TestParseThumbnailOptionsClampsDimensions(t *testing.T) {
+	r := httptest.NewRequest("GET", "/_thumbnail/a.png?width=100000&height=-5&fit=stretch", nil)
+	opts := parseThumbnailOptions(r)
+	if opts.width != 1920 || opts.height != 0 {
+		t.Errorf("Expected 1920x0, got %dx%d", opts.width, opts.height)
+	}
+	if opts.fit != "contain" || opts.gravity != "center" {
+		t.Errorf("Expected contain center, got %s %s", opts.fit, opts.gravity)
+	}
+}
+
+func TestParseThumbnailOptionsSnapsWidthToLadder(t *testing.T) {
+	cases := map[string][2]uint{
+		"width=600":                      {640, 0},
+		"width=600&height=450":           {640, 480},
+		"width=300&height=300&fit=cover": {320, 320},
+		"width=640&height=480":           {640, 480},
+		"height=300":                     {0, 300},
+	}
+	for params, expected := range cases {
+		opts := parseThumbnailOptions(httptest.NewRequest("GET", "/_thumbnail/a.png?"+params, nil))
+		if opts.width != expected[0] || opts.height != expected[1] {
+			t.Errorf("%s: expected %dx%d, got %dx%d", params, expected[0], expected[1], opts.width, opts.height)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TimelineDay is the media on one page taken on one day. A day that
+// carries on from the previous page is Continued and doesn't get a heading.
+type TimelineDay struct {
+	Date      time.Time
+	Anchor    string
+	Continued bool
+	Files     []GalleryFileData
+}
+
+// TimelineMonth is an entry in the scrubber for jumping to a date
+type TimelineMonth struct {
+	Label string
+	Link  string
+	Count int
+}
+
+type TimelineYear struct {
+	Year   int
+	Link   string
+	Months []TimelineMonth
+}
+
+type TimelineData struct {
+	Days     []TimelineDay
+	Years    []TimelineYear
+	Order    string
+	From     string
+	NextPage int
+	HasMore  bool
+}
+
+// NextPageURL loads the next page of the timeline from the same place
+func (timeline TimelineData) NextPageURL() string {
+	values := url.Values{"order": {timeline.Order}, "pageNum": {strconv.Itoa(timeline.NextPage)}}
+	if timeline.From != "" {
+		values.Set("from", timeline.From)
+	}
+	return "/_timeline?" + values.Encode()
+}
+
+// timelineSnapshot is the sorted timeline and its scrubber, kept until the
+// index changes so each page doesn't have to sort the whole library again
+type timelineSnapshot struct {
+	generation uint64
+	entries    []IndexEntry
+	years      []TimelineYear
+}
+
+type timelineKey struct {
+	index *LibraryIndex
+	order string
+}
+
+var (
+	timelineMu        sync.Mutex
+	timelineSnapshots = map[timelineKey]timelineSnapshot{}
+)
+
+// timelineEntries is every photo and video in the library, newest first
+// unless asked otherwise, with the scrubber for them
+func (hdlr RequestHandlers) timelineEntries(order string) ([]IndexEntry, []TimelineYear, error) {
+	if !hdlr.Index.Ready() {
+		// nothing knows when anything was taken yet, so it's by mtime and
+		// there's nothing to say when it's changed
+		entries, err := readTimelineEntries(order, hdlr.walkSearch, hdlr.MediaDirectory)
+		return entries, timelineYears(entries, order), err
+	}
+	key := timelineKey{hdlr.Index, order}
+	generation := hdlr.Index.Generation()
+	timelineMu.Lock()
+	snapshot, ok := timelineSnapshots[key]
+	timelineMu.Unlock()
+	if ok && snapshot.generation == generation {
+		return snapshot.entries, snapshot.years, nil
+	}
+	entries, err := readTimelineEntries(order, hdlr.Index.Walk, "/")
+	if err != nil {
+		return nil, nil, err
+	}
+	snapshot = timelineSnapshot{generation: generation, entries: entries, years: timelineYears(entries, order)}
+	timelineMu.Lock()
+	timelineSnapshots[key] = snapshot
+	timelineMu.Unlock()
+	return snapshot.entries, snapshot.years, nil
+}
+
+func readTimelineEntries(order string, walk func(string, func(IndexEntry) error) error, root string) ([]IndexEntry, error) {
+	entries := []IndexEntry{}
+	err := walk(root, func(entry IndexEntry) error {
+		if entry.Type == "image" || entry.Type == "video" {
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	entries = hidePosterSidecars(entries)
+	sortEntries(entries, Sorting{By: "taken", Order: order})
+	return entries, err
+}
+
+// timelineYears counts what was taken each month, for the scrubber
+func timelineYears(entries []IndexEntry, order string) []TimelineYear {
+	years := []TimelineYear{}
+	for _, entry := range entries {
+		taken := entryTaken(entry).Local()
+		if len(years) == 0 || years[len(years)-1].Year != taken.Year() {
+			years = append(years, TimelineYear{
+				Year: taken.Year(),
+				Link: timelineLink(taken.Format("2006"), order),
+			})
+		}
+		year := &years[len(years)-1]
+		month := taken.Format("Jan")
+		if len(year.Months) == 0 || year.Months[len(year.Months)-1].Label != month {
+			year.Months = append(year.Months, TimelineMonth{Label: month, Link: timelineLink(taken.Format("2006-01"), order)})
+		}
+		year.Months[len(year.Months)-1].Count++
+	}
+	return years
+}
+
+func timelineLink(from string, order string) string {
+	return "/_timeline?" + url.Values{"from": {from}, "order": {order}}.Encode()
+}
+
+func sameDay(a time.Time, b time.Time) bool {
+	return a.Year() == b.Year() && a.YearDay() == b.YearDay()
+}
+
+func (hdlr RequestHandlers) getTimelineData(query url.Values, pageNum int, pageLen int) (*TimelineData, error) {
+	order := query.Get("order")
+	if order != "asc" {
+		order = "desc"
+	}
+	entries, years, err := hdlr.timelineEntries(order)
+	if err != nil {
+		return nil, err
+	}
+	timeline := &TimelineData{Order: order, Years: years, NextPage: pageNum + 1}
+
+	// jumping to a date starts the timeline there
+	if from := query.Get("from"); from != "" {
+		start, end, err := parseQueryPeriod(from)
+		if err != nil {
+			return nil, err
+		}
+		timeline.From = from
+		skip := sort.Search(len(entries), func(i int) bool {
+			taken := entryTaken(entries[i])
+			if order == "asc" {
+				return !taken.Before(start)
+			}
+			return taken.Before(end)
+		})
+		entries = entries[skip:]
+	}
+
+	first := (pageNum - 1) * pageLen
+	if first > len(entries) {
+		first = len(entries)
+	}
+	last := int(math.Min(float64(first+pageLen), float64(len(entries))))
+	timeline.HasMore = last < len(entries)
+	for i := first; i < last; i++ {
+		taken := entryTaken(entries[i]).Local()
+		if len(timeline.Days) == 0 || !sameDay(timeline.Days[len(timeline.Days)-1].Date, taken) {
+			timeline.Days = append(timeline.Days, TimelineDay{
+				Date:      taken,
+				Anchor:    taken.Format("2006-01-02"),
+				Continued: i > 0 && sameDay(entryTaken(entries[i-1]).Local(), taken),
+			})
+		}
+		day := &timeline.Days[len(timeline.Days)-1]
+		day.Files = append(day.Files, newIndexedGalleryFileData(entries[i]))
+	}
+	for i := range timeline.Days {
+		hdlr.addVideoDetails(timeline.Days[i].Files)
+	}
+	return timeline, nil
+}
+
+// getTimeline shows the whole library by when things were taken
+func (hdlr RequestHandlers) getTimeline(w http.ResponseWriter, r *http.Request) {
+	pageNum, err := strconv.Atoi(r.URL.Query().Get("pageNum"))
+	if err != nil || pageNum < 1 {
+		pageNum = DEFAULT_PAGE_NUMBER
+	}
+	pageLen, err := strconv.Atoi(r.URL.Query().Get("pageLen"))
+	if err != nil || pageLen < 1 {
+		pageLen = DEFAULT_PAGE_LENGTH
+	}
+	if from := r.URL.Query().Get("from"); from != "" {
+		if _, _, err := parseQueryPeriod(from); err != nil {
+			http.Error(w, fmt.Sprintf("Can't jump to %q, use a year, month or day like 2022-04", from), http.StatusBadRequest)
+			return
+		}
+	}
+	timeline, err := hdlr.getTimelineData(r.URL.Query(), pageNum, pageLen)
+	if err != nil {
+		http.Error(w, "Something just went wrong", http.StatusInternalServerError)
+		return
+	}
+	data := PageData{
+		ShowBreadcrumb: true,
+		Breadcrumbs:    []Breadcrumb{{Name: "Timeline", Link: "/_timeline"}},
+		URL:            "/_timeline",
+		TimelineData:   timeline,
+	}
+	err = hdlr.Templates.ExecuteTemplate(w, "baseHTML", data)
+	if err != nil {
+		fmt.Println("Error rendering timeline:", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeline(t *testing.T) {
+	idx := openTestIndex(t, t.TempDir())
+	if err := idx.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	at := func(year int, month time.Month, day int, hour int) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, time.Local)
+	}
+	photo := func(path string, taken time.Time) IndexEntry {
+		return IndexEntry{
+			Path: path, Name: path[1:], Type: "image", Version: indexVersion, ModTime: time.Now(),
+			Metadata: &MediaMetadata{Image: &ImageMetadata{CapturedAt: &taken}},
+		}
+	}
+	for _, entry := range []IndexEntry{
+		photo("/spring1.jpg", at(2022, 4, 17, 10)),
+		photo("/spring2.jpg", at(2022, 4, 17, 11)),
+		photo("/spring3.jpg", at(2022, 4, 18, 9)),
+		photo("/winter.jpg", at(2021, 12, 25, 9)),
+		// no capture time, so it goes by when it was modified
+		{Path: "/clip.mp4", Name: "clip.mp4", Type: "video", Version: indexVersion, ModTime: at(2022, 5, 1, 12)},
+		{Path: "/notes.txt", Name: "notes.txt", Type: "other", Version: indexVersion, ModTime: at(2022, 5, 2, 12)},
+	} {
+		if err := idx.put(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hdlr := RequestHandlers{Index: idx}
+	days := func(timeline *TimelineData) string {
+		parts := []string{}
+		for _, day := range timeline.Days {
+			names := []string{}
+			for _, file := range day.Files {
+				names = append(names, file.Name)
+			}
+			heading := day.Anchor
+			if day.Continued {
+				heading = "..."
+			}
+			parts = append(parts, heading+" "+strings.Join(names, ","))
+		}
+		return strings.Join(parts, " | ")
+	}
+
+	first, err := hdlr.getTimelineData(url.Values{}, 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if days(first) != "2022-05-01 clip.mp4 | 2022-04-18 spring3.jpg | 2022-04-17 spring2.jpg" || !first.HasMore {
+		t.Errorf("Expected the newest three, but got %s", days(first))
+	}
+	second, _ := hdlr.getTimelineData(url.Values{}, 2, 3)
+	if days(second) != "... spring1.jpg | 2021-12-25 winter.jpg" || second.HasMore {
+		t.Errorf("Expected the 17th to carry on without a heading, but got %s", days(second))
+	}
+	if len(first.Years) != 2 || first.Years[0].Year != 2022 || len(first.Years[0].Months) != 2 || first.Years[0].Months[1].Count != 3 {
+		t.Errorf("Expected May and April 2022 then 2021 in the scrubber, but got %+v", first.Years)
+	}
+
+	jumped, _ := hdlr.getTimelineData(url.Values{"from": {"2021-12"}}, 1, 3)
+	if days(jumped) != "2021-12-25 winter.jpg" {
+		t.Errorf("Expected to jump to December 2021, but got %s", days(jumped))
+	}
+	if jumped.NextPageURL() != "/_timeline?from=2021-12&order=desc&pageNum=2" {
+		t.Errorf("Expected the next page to keep the jump, but got %s", jumped.NextPageURL())
+	}
+	oldest, _ := hdlr.getTimelineData(url.Values{"order": {"asc"}, "from": {"2022"}}, 1, 1)
+	if days(oldest) != "2022-04-17 spring1.jpg" {
+		t.Errorf("Expected the oldest of 2022, but got %s", days(oldest))
+	}
+
+	// pages come from the same sorted timeline until the index changes
+	idx.put(photo("/summer.jpg", at(2022, 7, 1, 9)))
+	latest, _ := hdlr.getTimelineData(url.Values{}, 1, 1)
+	if days(latest) != "2022-07-01 summer.jpg" {
+		t.Errorf("Expected a new photo to show up, but got %s", days(latest))
+	}
+}
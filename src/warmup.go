@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// warmupThumbnailFormats are what browsers showing the gallery negotiate,
+// webp for most and jpeg for anything that can't take it
+var warmupThumbnailFormats = []string{"webp", "jpeg"}
+
+type WarmupProgress struct {
+	Running    bool      `json:"running"`
+	Discovered int       `json:"discovered"`
+	Generated  int       `json:"generated"`
+	Skipped    int       `json:"skipped"`
+	Failed     int       `json:"failed"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+}
+
+// ThumbnailWarmer walks the media directory generating any thumbnails
+// that aren't cached yet. Anything already in the cache is skipped, so a
+// run interrupted by a restart picks up roughly where it left off.
+type ThumbnailWarmer struct {
+	MediaDirectory string
+	Thumbnailer    *Thumbnailer
+	Widths         []uint
+	// Formats are encoded for every width, warmupThumbnailFormats if empty
+	Formats []string
+	Workers int
+	// Context stops a run early, usually on shutdown
+	Context context.Context
+
+	mu       sync.Mutex
+	progress WarmupProgress
+}
+
+// Start kicks off a run in the background, returning false if one is
+// already going
+func (warmer *ThumbnailWarmer) Start() bool {
+	warmer.mu.Lock()
+	defer warmer.mu.Unlock()
+	if warmer.progress.Running {
+		return false
+	}
+	warmer.progress = WarmupProgress{Running: true, StartedAt: time.Now()}
+	ctx := warmer.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	go warmer.run(ctx)
+	return true
+}
+
+func (warmer *ThumbnailWarmer) Progress() WarmupProgress {
+	warmer.mu.Lock()
+	defer warmer.mu.Unlock()
+	return warmer.progress
+}
+
+func (warmer *ThumbnailWarmer) update(fn func(progress *WarmupProgress)) {
+	warmer.mu.Lock()
+	defer warmer.mu.Unlock()
+	fn(&warmer.progress)
+}
+
+func (warmer *ThumbnailWarmer) run(ctx context.Context) {
+	requests := make(chan thumbnailRequest)
+	workers := warmer.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for req := range requests {
+				warmer.generate(ctx, req)
+			}
+		}()
+	}
+
+	formats := warmer.Formats
+	if len(formats) == 0 {
+		formats = warmupThumbnailFormats
+	}
+	err := filepath.WalkDir(warmer.MediaDirectory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		prts := strings.Split(d.Name(), ".")
+		ext := strings.ToLower(prts[len(prts)-1])
+		isImage := slices.Contains(imageExtensions, ext)
+		isVideo := slices.Contains(videoExtensions, ext)
+		if !isImage && !isVideo {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		for _, width := range warmer.Widths {
+			for _, format := range formats {
+				opts := galleryThumbnailOptions(width)
+				opts.format = format
+				req := newThumbnailRequest(path, info, isVideo, opts)
+				warmer.update(func(progress *WarmupProgress) { progress.Discovered++ })
+				select {
+				case requests <- req:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+		return nil
+	})
+	close(requests)
+	wg.Wait()
+
+	warmer.update(func(progress *WarmupProgress) {
+		progress.Running = false
+		progress.FinishedAt = time.Now()
+	})
+	progress := warmer.Progress()
+	if err != nil {
+		fmt.Printf("thumbnail warmup stopped: %s\n", err)
+	}
+	fmt.Printf("thumbnail warmup finished: %d generated, %d already cached, %d failed in %s\n",
+		progress.Generated, progress.Skipped, progress.Failed, progress.FinishedAt.Sub(progress.StartedAt).Round(time.Second))
+}
+
+func (warmer *ThumbnailWarmer) generate(ctx context.Context, req thumbnailRequest) {
+	if warmer.Thumbnailer.Cache.Has(req.cacheKey()) {
+		warmer.update(func(progress *WarmupProgress) { progress.Skipped++ })
+		return
+	}
+	_, err := warmer.Thumbnailer.Load(ctx, req)
+	warmer.update(func(progress *WarmupProgress) {
+		if err != nil {
+			progress.Failed++
+		} else {
+			progress.Generated++
+		}
+		done := progress.Generated + progress.Failed
+		if done%100 == 0 {
+			fmt.Printf("thumbnail warmup: %d generated, %d already cached, %d failed, %d found so far\n",
+				progress.Generated, progress.Skipped, progress.Failed, progress.Discovered)
+		}
+	})
+}
+
+func (hdlr RequestHandlers) handleWarmup(w http.ResponseWriter, r *http.Request) {
+	if hdlr.ThumbnailWarmer == nil {
+		http.Error(w, "Thumbnail warmup unavailable", http.StatusNotFound)
+		return
+	}
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		if !hdlr.ThumbnailWarmer.Start() {
+			http.Error(w, "Thumbnail warmup already running", http.StatusConflict)
+			return
+		}
+		status = http.StatusAccepted
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(hdlr.ThumbnailWarmer.Progress())
+}
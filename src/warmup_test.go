@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestThumbnailWarmer(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPng(t, filepath.Join(dir, "a.png"), 40, 30)
+	writeTestPng(t, filepath.Join(dir, "nested", "b.png"), 30, 40)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("hello"), 0644)
+	cache, err := NewDiskCache(t.TempDir(), 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	warmer := &ThumbnailWarmer{
+		MediaDirectory: dir,
+		Thumbnailer:    NewThumbnailer(cache, 2, 1, 10*time.Second),
+		Widths:         []uint{320},
+		Formats:        []string{"jpeg", "png"},
+		Workers:        2,
+	}
+	hdlr := RequestHandlers{ThumbnailWarmer: warmer}
+	finished := func() bool { return !warmer.Progress().Running }
+
+	rec := httptest.NewRecorder()
+	hdlr.handleWarmup(rec, httptest.NewRequest("POST", "/_warmup", nil))
+	if rec.Code != http.StatusAccepted {
+		t.Errorf("Expected 202, but got %d", rec.Code)
+	}
+	waitFor(t, "the warmup to finish", finished)
+	progress := warmer.Progress()
+	if progress.Discovered != 4 || progress.Generated != 4 || progress.Skipped != 0 || progress.Failed != 0 {
+		t.Errorf("Expected 4 thumbnails generated, but got %+v", progress)
+	}
+	for _, name := range []string{"a.png", "nested/b.png"} {
+		path := filepath.Join(dir, name)
+		info, _ := os.Stat(path)
+		for _, format := range warmer.Formats {
+			opts := galleryThumbnailOptions(320)
+			opts.format = format
+			if !cache.Has(newThumbnailRequest(path, info, false, opts).cacheKey()) {
+				t.Errorf("Expected a cached %s thumbnail for %s", format, name)
+			}
+		}
+	}
+
+	// a second run finds everything cached
+	warmer.Start()
+	waitFor(t, "the second warmup to finish", finished)
+	rec = httptest.NewRecorder()
+	hdlr.handleWarmup(rec, httptest.NewRequest("GET", "/_warmup", nil))
+	var reported WarmupProgress
+	if err := json.NewDecoder(rec.Body).Decode(&reported); err != nil {
+		t.Fatal(err)
+	}
+	if reported.Running || reported.Skipped != 4 || reported.Generated != 0 {
+		t.Errorf("Expected all 4 to be skipped, but got %+v", reported)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// LibraryWatcher follows changes under the media directory, updating the
+// library index and dropping cached thumbnails, previews and transcodes of
+// files that have changed. Bursts of events, like a camera import, are
+// gathered up and handled together once things go quiet for Debounce.
+type LibraryWatcher struct {
+	MediaDirectory string
+	Index          *LibraryIndex
+	Thumbnailer    *Thumbnailer
+	Transcoder     *HlsTranscoder
+	Debounce       time.Duration
+	// FallbackRescan is how often the whole library is rescanned instead,
+	// if the system won't let us watch every directory
+	FallbackRescan time.Duration
+
+	watcher    *fsnotify.Watcher
+	limited    atomic.Bool
+	rescanning atomic.Bool
+}
+
+// Start begins watching in the background until ctx is done
+func (lw *LibraryWatcher) Start(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	lw.watcher = watcher
+	lw.watchTree(lw.MediaDirectory, nil)
+	go lw.run(ctx)
+	return nil
+}
+
+// Limited is whether the watch limit was hit, and the library is being
+// rescanned periodically rather than watched
+func (lw *LibraryWatcher) Limited() bool {
+	return lw.limited.Load()
+}
+
+// isWatchLimit is whether adding a watch failed because there are too many
+// already, fs.inotify.max_user_watches on linux
+func isWatchLimit(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EMFILE)
+}
+
+// watchTree watches root and every directory under it, passing every path
+// found to found so files in newly created directories get indexed
+func (lw *LibraryWatcher) watchTree(root string, found func(path string)) {
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if found != nil && path != root {
+			found(path)
+		}
+		if !d.IsDir() || lw.Limited() {
+			return nil
+		}
+		err = lw.watcher.Add(path)
+		if isWatchLimit(err) {
+			lw.limited.Store(true)
+			fmt.Printf("watch limit reached at %s, rescanning the library every %s instead\n", path, lw.FallbackRescan)
+		} else if err != nil {
+			fmt.Printf("unable to watch %s: %s\n", path, err)
+		}
+		return nil
+	})
+}
+
+func (lw *LibraryWatcher) run(ctx context.Context) {
+	defer lw.watcher.Close()
+	// batches are applied off the event loop, so events keep being read
+	// while a big import is indexed
+	batches := make(chan map[string]fsnotify.Op)
+	defer close(batches)
+	go func() {
+		for changes := range batches {
+			lw.apply(changes)
+		}
+	}()
+	pending := map[string]fsnotify.Op{}
+	flush := time.NewTimer(lw.Debounce)
+	flush.Stop()
+	var fallback <-chan time.Time
+	for {
+		if fallback == nil && lw.Limited() && lw.FallbackRescan > 0 {
+			ticker := time.NewTicker(lw.FallbackRescan)
+			defer ticker.Stop()
+			fallback = ticker.C
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-lw.watcher.Events:
+			if !ok {
+				return
+			}
+			pending[event.Name] |= event.Op
+			if event.Has(fsnotify.Create) {
+				// a directory that's been created or moved in needs watching,
+				// and anything already in it needs indexing
+				lw.watchTree(event.Name, func(path string) {
+					pending[path] |= fsnotify.Create
+				})
+			}
+			flush.Reset(lw.Debounce)
+		case err, ok := <-lw.watcher.Errors:
+			if !ok {
+				return
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				// events were dropped, so there's no knowing what changed
+				fmt.Println("too many filesystem events, rescanning the library")
+				lw.rescan(ctx)
+				continue
+			}
+			fmt.Println("Error watching media directory:", err)
+		case <-flush.C:
+			select {
+			case batches <- pending:
+				pending = map[string]fsnotify.Op{}
+			default:
+				// the last batch is still being applied, this one waits
+				// and picks up anything else that changes meanwhile
+				flush.Reset(lw.Debounce)
+			}
+		case <-fallback:
+			lw.rescan(ctx)
+		}
+	}
+}
+
+// rescan runs a full scan in the background, unless one is already going
+func (lw *LibraryWatcher) rescan(ctx context.Context) {
+	if lw.Index == nil || !lw.rescanning.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer lw.rescanning.Store(false)
+		err := lw.Index.Scan(ctx)
+		if err != nil {
+			fmt.Printf("library scan stopped: %s\n", err)
+		}
+	}()
+}
+
+// apply handles a settled batch of changed paths and what happened to
+// them. The index is refreshed a directory at a time, so a thousand new
+// photos in one folder read that folder once rather than a thousand times.
+// Only what's actually gone or changed has its cached files dropped.
+func (lw *LibraryWatcher) apply(changes map[string]fsnotify.Op) {
+	directories := map[string]bool{}
+	for path, op := range changes {
+		rel, err := filepath.Rel(lw.MediaDirectory, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		p := mediaPath(filepath.ToSlash(rel))
+		info, err := os.Stat(path)
+		gone := err != nil || op.Has(fsnotify.Remove) || op.Has(fsnotify.Rename)
+		switch {
+		case gone:
+			lw.invalidate(path)
+			if lw.Index != nil {
+				// a directory that's gone takes what was in it with it
+				lw.Index.Walk(p, func(entry IndexEntry) error {
+					lw.invalidate(lw.Index.fullPath(entry.Path))
+					return nil
+				})
+			}
+		case info.IsDir():
+			if op == fsnotify.Chmod {
+				// its permissions or times changed, not what's in it
+				continue
+			}
+			// anything in it that changed has an event of its own
+			directories[p] = true
+		case lw.changed(p, info, op):
+			lw.invalidate(path)
+		default:
+			continue
+		}
+		directories[parentPath(p)] = true
+	}
+	if lw.Index == nil {
+		return
+	}
+	sorted := []string{}
+	for p := range directories {
+		sorted = append(sorted, p)
+	}
+	// parents first, so new directories are in the index before their files
+	sort.Strings(sorted)
+	for _, p := range sorted {
+		err := lw.Index.Refresh(p)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			fmt.Printf("unable to index %s: %s\n", p, err)
+		}
+	}
+}
+
+// changed is whether a file that's still there isn't what was indexed
+func (lw *LibraryWatcher) changed(p string, info fs.FileInfo, op fsnotify.Op) bool {
+	if lw.Index == nil {
+		return op != fsnotify.Chmod
+	}
+	entry, found := lw.Index.Get(p)
+	return !found || entry.Size != info.Size() || !entry.ModTime.Equal(info.ModTime())
+}
+
+// invalidate drops everything cached from a file
+func (lw *LibraryWatcher) invalidate(path string) {
+	prefix := sourceCacheKey(path) + "-"
+	if lw.Thumbnailer != nil {
+		lw.Thumbnailer.Cache.Prune(prefix, "")
+	}
+	if lw.Transcoder != nil {
+		lw.Transcoder.Cache.Prune(prefix, "")
+	}
+	probes.Prune(prefix)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, what string, check func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestLibraryWatcher(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPng(t, filepath.Join(dir, "a.png"), 10, 10)
+	idx := openTestIndex(t, dir)
+	if err := idx.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewDiskCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aPath := filepath.Join(dir, "a.png")
+	info, _ := os.Stat(aPath)
+	cache.putDerived(aPath, info, "thumb", []byte("stale"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watcher := &LibraryWatcher{
+		MediaDirectory: dir,
+		Index:          idx,
+		Thumbnailer:    &Thumbnailer{Cache: cache},
+		Debounce:       50 * time.Millisecond,
+	}
+	if err := watcher.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// a folder of photos copied in all at once
+	importDir := filepath.Join(dir, "import")
+	os.Mkdir(importDir, 0755)
+	for _, name := range []string{"1.png", "2.png", "3.png"} {
+		writeTestPng(t, filepath.Join(importDir, name), 20, 20)
+	}
+	waitFor(t, "imported photos to be indexed", func() bool {
+		entry, found := idx.Get("/import/3.png")
+		return found && entry.Width == 20
+	})
+	if entry, _ := idx.Get("/import"); entry.FileCount != 3 {
+		t.Errorf("Expected 3 files in /import, but got %d", entry.FileCount)
+	}
+
+	// changing permissions or times on directories leaves what's cached
+	// from the files in them alone
+	os.Chmod(dir, 0755)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(importDir, later, later)
+	writeTestPng(t, filepath.Join(dir, "b.png"), 10, 10)
+	waitFor(t, "b.png to be indexed", func() bool {
+		_, found := idx.Get("/b.png")
+		return found
+	})
+	if !cache.Has(derivedCacheKey(aPath, info, "thumb")) {
+		t.Errorf("Expected a.png's thumbnails to survive its directory being touched")
+	}
+
+	os.Remove(aPath)
+	waitFor(t, "a removed photo to leave the index", func() bool {
+		_, found := idx.Get("/a.png")
+		return !found
+	})
+	if cache.Has(derivedCacheKey(aPath, info, "thumb")) {
+		t.Errorf("Expected a removed photo's thumbnails to be dropped")
+	}
+}
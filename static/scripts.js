@@ -14,4 +14,114 @@ function toggleDirectories() {
     directoryContainer.style.maxHeight = isHidden ? '12em' : '0';
     directoryContainer.style.padding = isHidden ? '1em' : '0';
     button.textContent = isHidden ? 'Directories' : 'Collapse';
-}
\ No newline at end of file
+}
+
+// Swap a thumbnail for its animated preview while the mouse is over it.
+// Listening on the document keeps it working for htmx loaded pages.
+document.addEventListener("mouseover", (event) => {
+    const thumbnail = event.target.closest && event.target.closest("[data-preview]");
+    if (!thumbnail || thumbnail.querySelector("video")) {
+        return;
+    }
+    const img = thumbnail.querySelector("img");
+    const preview = document.createElement("video");
+    preview.src = thumbnail.dataset.preview;
+    preview.muted = true;
+    preview.loop = true;
+    preview.autoplay = true;
+    preview.playsInline = true;
+    preview.className = "preview";
+    // keep showing the thumbnail until there's something to play
+    preview.addEventListener("playing", () => { img.style.display = "none"; });
+    preview.addEventListener("error", () => { preview.remove(); });
+    img.after(preview);
+    thumbnail.addEventListener("mouseleave", () => {
+        preview.remove();
+        img.style.display = "";
+    }, { once: true });
+});
+
+function parseVttTimestamp(timestamp) {
+    return timestamp.split(":").reduce((total, part) => total * 60 + parseFloat(part), 0);
+}
+
+// Show the frame from the storyboard WebVTT track above the seek bar while
+// hovering over it
+function attachSeekThumbnails(player, storyboardUrl) {
+    fetch(storyboardUrl)
+        .then((response) => response.ok ? response.text() : Promise.reject(response.status))
+        .then((vtt) => {
+            const cues = vtt.split(/\n\n+/).slice(1).map((block) => {
+                const [timing, target] = block.trim().split("\n");
+                const [start, end] = timing.split(" --> ").map(parseVttTimestamp);
+                const [image, xywh] = target.split("#xywh=");
+                const [x, y, w, h] = xywh.split(",").map(Number);
+                return { start, end, image, x, y, w, h };
+            });
+            const progress = player.el().querySelector(".vjs-progress-control");
+            const preview = document.createElement("div");
+            preview.className = "seek-thumbnail";
+            progress.appendChild(preview);
+
+            progress.addEventListener("mousemove", (event) => {
+                const bounds = progress.getBoundingClientRect();
+                const fraction = Math.min(Math.max((event.clientX - bounds.left) / bounds.width, 0), 1);
+                const time = fraction * player.duration();
+                const cue = cues.find((c) => time >= c.start && time < c.end) || cues[cues.length - 1];
+                if (!cue) {
+                    return;
+                }
+                preview.style.width = cue.w + "px";
+                preview.style.height = cue.h + "px";
+                preview.style.backgroundImage = "url('" + cue.image + "')";
+                preview.style.backgroundPosition = "-" + cue.x + "px -" + cue.y + "px";
+                const left = Math.min(Math.max(event.clientX - bounds.left - cue.w / 2, 0), bounds.width - cue.w);
+                preview.style.left = left + "px";
+                preview.style.display = "block";
+            });
+            progress.addEventListener("mouseleave", () => { preview.style.display = "none"; });
+        })
+        .catch(() => { /* no seek previews, the player still works */ });
+}
+
+// A remuxed stream can't be seeked into, so seeking asks the server for a
+// new stream starting at that time and the player's clock is shifted to
+// match
+function attachRemuxSeeking(player, streamUrl) {
+    player.remuxUrl = streamUrl;
+    if (player.remuxOffset !== undefined) {
+        return;
+    }
+    player.remuxOffset = 0;
+    const currentTime = player.currentTime;
+    player.currentTime = function (seconds) {
+        if (!player.remuxUrl) {
+            return currentTime.apply(player, arguments);
+        }
+        if (seconds === undefined) {
+            return player.remuxOffset + currentTime.call(player);
+        }
+        player.remuxOffset = seconds;
+        const separator = player.remuxUrl.includes("?") ? "&" : "?";
+        player.src({ src: player.remuxUrl + separator + "start=" + seconds, type: "video/mp4" });
+        player.play();
+        return seconds;
+    };
+}
+
+// Switch to the stream with the audio track picked in select, carrying on
+// from the same point
+function switchAudioTrack(player, select) {
+    const option = select.selectedOptions[0];
+    const time = player.currentTime();
+    if (option.dataset.remux) {
+        attachRemuxSeeking(player, option.value);
+        player.currentTime(time);
+        return;
+    }
+    player.remuxUrl = null;
+    player.remuxOffset = 0;
+    player.src({ src: option.value, type: option.dataset.type });
+    player.one("loadedmetadata", () => player.currentTime(time));
+    player.play();
+}